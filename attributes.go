@@ -0,0 +1,122 @@
+package iotfwdrv
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var ErrReadOnly = errors.New("attribute is read only")
+var ErrInvalidValue = errors.New("invalid value")
+
+// AttributeDescriptor describes an attribute as reported by the list command,
+// firmware that only sends name and value leaves everything else empty
+type AttributeDescriptor struct {
+	Name        string
+	Type        string
+	ReadOnly    bool
+	Min         *float64
+	Max         *float64
+	Unit        string
+	Description string
+	// Args holds every argument of the attr packet including unrecognised ones
+	Args map[string]string
+}
+
+func newAttributeDescriptor(args map[string]string) AttributeDescriptor {
+	desc := AttributeDescriptor{
+		Name:        args["name"],
+		Type:        args["type"],
+		Unit:        args["unit"],
+		Description: firstArg(args, "desc", "description"),
+		Args:        make(map[string]string, len(args)),
+	}
+	for k, v := range args {
+		desc.Args[k] = v
+	}
+	if ro := firstArg(args, "ro", "readonly"); ro != "" {
+		desc.ReadOnly, _ = strconv.ParseBool(ro)
+	}
+	if min, err := strconv.ParseFloat(args["min"], 64); err == nil {
+		desc.Min = &min
+	}
+	if max, err := strconv.ParseFloat(args["max"], 64); err == nil {
+		desc.Max = &max
+	}
+	return desc
+}
+
+func firstArg(args map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v, ok := args[k]; ok {
+			return v
+		}
+	}
+	return ""
+}
+
+// Validate checks value against the descriptor, types it does not know are
+// passed through for the device to judge
+func (a AttributeDescriptor) Validate(value string) error {
+	if a.ReadOnly {
+		return fmt.Errorf("%s: %w", a.Name, ErrReadOnly)
+	}
+
+	var num float64
+	var err error
+	switch a.Type {
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	case "int":
+		var i int64
+		i, err = strconv.ParseInt(value, 10, 64)
+		num = float64(i)
+	case "uint":
+		var u uint64
+		u, err = strconv.ParseUint(value, 10, 64)
+		num = float64(u)
+	case "float":
+		num, err = strconv.ParseFloat(value, 64)
+	default:
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s is not of type %s", a.Name, ErrInvalidValue, value, a.Type)
+	}
+	if a.Type == "bool" {
+		return nil
+	}
+	if a.Min != nil && num < *a.Min {
+		return fmt.Errorf("%s: %w: %s is below minimum %g", a.Name, ErrInvalidValue, value, *a.Min)
+	}
+	if a.Max != nil && num > *a.Max {
+		return fmt.Errorf("%s: %w: %s is above maximum %g", a.Name, ErrInvalidValue, value, *a.Max)
+	}
+	return nil
+}
+
+// Attributes returns the descriptors reported by the device in list order
+func (dev *Device) Attributes() []AttributeDescriptor {
+	dev.valuesLock.Lock()
+	defer dev.valuesLock.Unlock()
+	attrs := make([]AttributeDescriptor, 0, len(dev.attributeOrder))
+	for _, name := range dev.attributeOrder {
+		attrs = append(attrs, dev.attributes[name])
+	}
+	return attrs
+}
+
+// Attribute returns the descriptor for a single attribute
+func (dev *Device) Attribute(name string) (AttributeDescriptor, bool) {
+	dev.valuesLock.Lock()
+	defer dev.valuesLock.Unlock()
+	a, ok := dev.attributes[name]
+	return a, ok
+}
+
+func (dev *Device) validate(name string, value string) error {
+	if a, ok := dev.Attribute(name); ok {
+		return a.Validate(value)
+	}
+	return nil
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/olekukonko/tablewriter"
 	"github.com/pborges/iotfwdrv"
 	"io"
+	"log/slog"
 	"net"
 	"os"
 	"sort"
@@ -22,11 +25,16 @@ func main() {
 	}
 
 	var scanCmd = &cobra.Command{
-		Use:   "scan",
+		Use:   "scan [cidr...]",
 		Short: "Scan for iotfw devices",
-		Long:  "Scan for iotfw devices on the given networks",
+		Long:  "Scan for iotfw devices on the given networks, a bare IP scans its /24, defaults to the local networks",
 		Run:   runScan,
 	}
+	scanCmd.Flags().IntSlice("port", []int{iotfwdrv.DefaultPort}, "ports to probe on every host")
+	scanCmd.Flags().Int("workers", iotfwdrv.DefaultScanWorkers, "hosts probed at once")
+	scanCmd.Flags().Duration("timeout", iotfwdrv.DefaultScanTimeout, "per host timeout")
+	scanCmd.Flags().Bool("errors", false, "print the hosts that did not answer")
+	scanCmd.Flags().Bool("full", false, "connect fully to learn device names, slower")
 
 	var discoverCmd = &cobra.Command{
 		Use:   "discover",
@@ -88,12 +96,12 @@ func runGet(cmd *cobra.Command, args []string) {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
-	addr := fmt.Sprintf("%s:%d", ip, port)
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
 
 	dev := iotfwdrv.New(func() (io.ReadWriteCloser, error) {
 		return net.DialTimeout("tcp", addr, 2*time.Second)
 	})
-	dev.Log.SetOutput(os.Stdout)
+	dev.Log = slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	if err := dev.Connect(); err == nil {
 		fmt.Println("get", args[0], "value:", dev.Get(args[0]))
@@ -114,12 +122,12 @@ func runSet(cmd *cobra.Command, args []string) {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
-	addr := fmt.Sprintf("%s:%d", ip, port)
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
 
 	dev := iotfwdrv.New(func() (io.ReadWriteCloser, error) {
 		return net.DialTimeout("tcp", addr, 2*time.Second)
 	})
-	dev.Log.SetOutput(os.Stdout)
+	dev.Log = slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	if err := dev.Connect(); err == nil {
 		fmt.Println("set", args[0], args[1], "err:", dev.Set(args[0], args[1]))
@@ -140,12 +148,12 @@ func runSub(cmd *cobra.Command, args []string) {
 		fmt.Println(err)
 		os.Exit(-1)
 	}
-	addr := fmt.Sprintf("%s:%d", ip, port)
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
 
 	dev := iotfwdrv.New(func() (io.ReadWriteCloser, error) {
 		return net.DialTimeout("tcp", addr, 2*time.Second)
 	})
-	dev.Log.SetOutput(os.Stdout)
+	dev.Log = slog.New(slog.NewTextHandler(os.Stdout, nil))
 
 	if err := dev.Connect(); err == nil {
 		fmt.Println("sub", args[0])
@@ -159,33 +167,65 @@ func runSub(cmd *cobra.Command, args []string) {
 }
 
 func runScan(cmd *cobra.Command, args []string) {
-	networks, err := iotfwdrv.LocalNetworks()
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+	var opts iotfwdrv.ScanOptions
+	for _, a := range args {
+		if !strings.Contains(a, "/") {
+			a += "/24"
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		opts.Networks = append(opts.Networks, n)
 	}
-
-	if len(args) > 0 {
-		networks = make([]net.IP, 0)
-		for _, a := range args {
-			networks = append(networks, net.ParseIP(a))
+	if len(opts.Networks) == 0 {
+		networks, err := iotfwdrv.LocalNetworks()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
 		}
+		opts.Networks = networks
 	}
+	opts.Ports, _ = cmd.Flags().GetIntSlice("port")
+	opts.Workers, _ = cmd.Flags().GetInt("workers")
+	opts.Timeout, _ = cmd.Flags().GetDuration("timeout")
+	opts.FullHandshake, _ = cmd.Flags().GetBool("full")
 
-	fmt.Println("Attempting discovery on", networks)
-	devs, devErrs := iotfwdrv.Scan(networks...)
+	opts.OnFound = func(m iotfwdrv.MetadataAndAddr) {
+		fmt.Fprintf(os.Stderr, "\rfound %s (%s) at %s\033[K\n", m.ID, m.Name, m.Addr.String())
+	}
+	opts.OnProgress = func(p iotfwdrv.ScanProgress) {
+		fmt.Fprintf(os.Stderr, "\rprobed %d/%d found %d refused %d timeout %d unreachable %d other %d\033[K",
+			p.Probed, p.Total, p.Found, p.Refused, p.Timeout, p.Unreachable, p.Other)
+	}
+
+	fmt.Println("Attempting discovery on", opts.Networks)
+	devs, err := iotfwdrv.ScanContext(context.Background(), opts)
+	fmt.Fprintln(os.Stderr)
+	var ipErrs iotfwdrv.IPErrors
+	if err != nil && !errors.As(err, &ipErrs) {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
 
 	renderMetadataTable(devs...)
+	if !opts.FullHandshake {
+		for _, m := range devs {
+			if m.Name == "" {
+				fmt.Fprintln(os.Stderr, "some firmware leaves the name out of info, use --full to fetch it")
+				break
+			}
+		}
+	}
 
 	if showErrors, err := cmd.Flags().GetBool("errors"); err == nil && showErrors {
-		if ipErrs, ok := devErrs.(iotfwdrv.IPErrors); ok {
-			// dump errors
-			sort.Slice(ipErrs, func(i, j int) bool {
-				return ipErrs[i].IP.To4()[3] < ipErrs[j].IP.To4()[3]
-			})
-			for _, e := range ipErrs {
-				fmt.Println(e.Error())
-			}
+		// dump errors
+		sort.Slice(ipErrs, func(i, j int) bool {
+			return bytes.Compare(ipErrs[i].IP.To16(), ipErrs[j].IP.To16()) < 0
+		})
+		for _, e := range ipErrs {
+			fmt.Println(e.Error())
 		}
 	}
 }
@@ -205,9 +245,13 @@ func runDiscover(cmd *cobra.Command, args []string) {
 		}
 	}()
 
-	iotfwdrv.HandleMDNS(context.Background(), func(m iotfwdrv.MetadataAndAddr) {
+	err := iotfwdrv.HandleMDNS(context.Background(), func(m iotfwdrv.MetadataAndAddr) {
 		devCh <- m
 	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
 }
 
 func renderMetadataTable(devs ...iotfwdrv.MetadataAndAddr) {
@@ -215,7 +259,7 @@ func renderMetadataTable(devs ...iotfwdrv.MetadataAndAddr) {
 	table.SetHeader([]string{"ID", "Name", "Model", "HW VER", "FW VER", "IP", "PORT"})
 	table.SetFooter([]string{"", "", "", "", "", "TOTAL", strconv.Itoa(len(devs))})
 	sort.Slice(devs, func(i, j int) bool {
-		return strings.Compare(devs[i].Name, devs[j].Name) < 0
+		return strings.Compare(devs[i].ID, devs[j].ID) < 0
 	})
 
 	for _, dev := range devs {
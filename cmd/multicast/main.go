@@ -2,49 +2,45 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
-	"strings"
-)
+	"time"
 
-const MaxDatagramSize = 256
+	"github.com/pborges/iotfwdrv"
+)
 
 func main() {
-	addr, err := net.ResolveUDPAddr("udp", "226.1.13.37:5000")
-	if err != nil {
-		log.Fatal(err)
-	}
+	ifaceName := flag.String("interface", "", "interface to probe on")
+	timeout := flag.Duration("timeout", iotfwdrv.DefaultMulticastTimeout, "how long to wait for replies")
+	flag.Parse()
 
-	go func() {
-		conn, err := net.ListenMulticastUDP("udp", nil, addr)
+	d := iotfwdrv.MulticastDiscoverer{
+		Timeout: *timeout,
+		OnFound: func(m iotfwdrv.MetadataAndAddr) {
+			fmt.Println(m.ID, m.Name, m.Model, m.HardwareVer, m.FirmwareVer, m.Addr.String())
+		},
+		OnError: func(err error) {
+			fmt.Println(err)
+		},
+	}
+	if *ifaceName != "" {
+		iface, err := net.InterfaceByName(*ifaceName)
 		if err != nil {
 			log.Fatal(err)
 		}
-
-		conn.SetReadBuffer(MaxDatagramSize)
-		for {
-			b := make([]byte, MaxDatagramSize)
-			n, src, err := conn.ReadFromUDP(b)
-			if err != nil {
-				log.Fatal("ReadFromUDP failed:", err)
-			}
-			res := string(b[:n])
-			if strings.HasPrefix(res, "iotfw found ") {
-				fmt.Println(strings.TrimPrefix(res, "iotfw found "), src)
-			}
-		}
-	}()
-
-	c, err := net.DialUDP("udp", nil, addr)
-	if err != nil {
-		log.Fatal(err)
+		d.Interface = iface
 	}
+
 	for {
-		bufio.NewReader(os.Stdin).ReadLine()
-		if _, err := c.Write([]byte("iotfw discover")); err != nil {
+		devs, err := d.Discover(context.Background())
+		if err != nil {
 			log.Fatal(err)
 		}
+		fmt.Println(len(devs), "devices found at", time.Now().Format(time.TimeOnly), "press enter to probe again")
+		bufio.NewReader(os.Stdin).ReadLine()
 	}
 }
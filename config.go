@@ -0,0 +1,299 @@
+package iotfwdrv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Duration is a time.Duration written as a string such as "5s" in a Config
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// ReconnectConfig describes a ReconnectPolicy, an ExponentialBackoff when Max
+// is set and a ConstantBackoff of Initial otherwise, wrapped in GiveUpAfter
+// when Attempts is set
+type ReconnectConfig struct {
+	Initial    Duration `json:"initial"`
+	Max        Duration `json:"max,omitempty"`
+	Multiplier float64  `json:"multiplier,omitempty"`
+	Jitter     float64  `json:"jitter,omitempty"`
+	Attempts   int      `json:"attempts,omitempty"`
+}
+
+func (c ReconnectConfig) Policy() ReconnectPolicy {
+	var policy ReconnectPolicy = ConstantBackoff{Delay: time.Duration(c.Initial)}
+	if c.Max > 0 {
+		policy = ExponentialBackoff{
+			Initial:    time.Duration(c.Initial),
+			Max:        time.Duration(c.Max),
+			Multiplier: c.Multiplier,
+			Jitter:     c.Jitter,
+		}
+	}
+	if c.Attempts > 0 {
+		policy = GiveUpAfter{Attempts: c.Attempts, Policy: policy}
+	}
+	return policy
+}
+
+// DeviceConfig is a device the Service dials directly instead of waiting for
+// discovery, Addr is a host:port and is resolved on every dial
+type DeviceConfig struct {
+	Addr string `json:"addr"`
+	// ID refuses any other device answering on Addr when set
+	ID          string           `json:"id,omitempty"`
+	Alias       string           `json:"alias,omitempty"`
+	DialTimeout Duration         `json:"dial_timeout,omitempty"`
+	Timeout     Duration         `json:"timeout,omitempty"`
+	Reconnect   *ReconnectConfig `json:"reconnect,omitempty"`
+	// Set is applied on every connect, SetOnDisconnect is handed to the device
+	// on every connect for it to apply when the driver goes away
+	Set             map[string]interface{} `json:"set,omitempty"`
+	SetOnDisconnect map[string]interface{} `json:"set_on_disconnect,omitempty"`
+}
+
+// Config is the static configuration of a Service
+//
+//	{
+//	  "devices": [
+//	    {
+//	      "addr": "10.0.20.5:5000",
+//	      "id": "a4cf12f00d",
+//	      "alias": "garage door",
+//	      "timeout": "5s",
+//	      "reconnect": {"initial": "1s", "max": "2m"},
+//	      "set": {"led.0": true},
+//	      "set_on_disconnect": {"led.0": false}
+//	    }
+//	  ]
+//	}
+type Config struct {
+	Devices []DeviceConfig `json:"devices"`
+}
+
+func ReadConfig(path string) (cfg Config, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	// numbers in set stay as written, a float64 would reach the device as 1e+06
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(&cfg); err != nil {
+		err = fmt.Errorf("%s: %w", path, err)
+		return
+	}
+	err = cfg.Validate()
+	return
+}
+
+func (c Config) Validate() error {
+	seen := make(map[string]bool)
+	for i, d := range c.Devices {
+		if _, _, err := net.SplitHostPort(d.Addr); err != nil {
+			return fmt.Errorf("device %d: %w", i, err)
+		}
+		if seen[d.Addr] {
+			return fmt.Errorf("device %d: duplicate addr %s", i, d.Addr)
+		}
+		seen[d.Addr] = true
+	}
+	return nil
+}
+
+// LoadConfig reads path and applies it with ApplyConfig
+func (s *Service) LoadConfig(path string) error {
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		return err
+	}
+	s.ApplyConfig(cfg)
+	return nil
+}
+
+// ApplyConfig registers the configured devices. Devices whose entry changed
+// since the last call are registered again with the new options and devices
+// whose entry was removed are unregistered. Devices are dialed in the
+// background and retried with their reconnect policy until they connect, a
+// device already known through discovery takes on its entry.
+func (s *Service) ApplyConfig(cfg Config) {
+	next := make(map[string]DeviceConfig, len(cfg.Devices))
+	for _, d := range cfg.Devices {
+		next[d.Addr] = d
+	}
+
+	var removed, added []DeviceConfig
+	s.exec(func() {
+		for addr, d := range s.configs {
+			if n, ok := next[addr]; !ok || !reflect.DeepEqual(n, d) {
+				removed = append(removed, d)
+			}
+		}
+		for addr, d := range next {
+			if o, ok := s.configs[addr]; !ok || !reflect.DeepEqual(o, d) {
+				added = append(added, d)
+			}
+		}
+		s.configs = next
+	})
+	sort.Slice(added, func(i, j int) bool {
+		return added[i].Addr < added[j].Addr
+	})
+
+	for _, d := range removed {
+		d := d
+		s.exec(func() {
+			for _, ctx := range s.devices {
+				if ctx.config != nil && ctx.config.Addr == d.Addr {
+					s.unregister(ctx, "config changed")
+				}
+			}
+		})
+	}
+	for _, d := range added {
+		s.registerConfig(d)
+	}
+}
+
+// DefaultConfigWatchInterval is how often WatchConfig checks the file unless
+// overridden
+const DefaultConfigWatchInterval = 5 * time.Second
+
+// WatchConfig loads path and reloads it whenever its modification time
+// changes until ctx is done, checking every interval or every
+// DefaultConfigWatchInterval when interval is not positive. Only the initial
+// load returns an error, a bad reload is logged and the previous configuration
+// stays in effect.
+func (s *Service) WatchConfig(ctx context.Context, path string, interval time.Duration) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := s.LoadConfig(path); err != nil {
+		return err
+	}
+	modTime := stat.ModTime()
+	if interval <= 0 {
+		interval = DefaultConfigWatchInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			stat, err := os.Stat(path)
+			if err != nil {
+				s.log().Warn("unable to stat config", "path", path, "err", err)
+				continue
+			}
+			if stat.ModTime().Equal(modTime) {
+				continue
+			}
+			modTime = stat.ModTime()
+			if err := s.LoadConfig(path); err != nil {
+				s.log().Error("unable to reload config", "path", path, "err", err)
+				continue
+			}
+			s.log().Info("reloaded config", "path", path)
+		}
+	}()
+	return nil
+}
+
+// registerConfig dials d in the background, an unreachable device is retried
+// with its reconnect policy until it connects or its entry changes
+func (s *Service) registerConfig(d DeviceConfig) {
+	policy := s.reconnectPolicy()
+	if d.Reconnect != nil {
+		policy = d.Reconnect.Policy()
+	}
+	resolve := func() (m MetadataAndAddr, cfg *DeviceConfig, err error) {
+		// resolved on every attempt, a name may point elsewhere by now
+		addr, err := net.ResolveTCPAddr("tcp", d.Addr)
+		if err != nil {
+			return
+		}
+		m = MetadataAndAddr{
+			Metadata: Metadata{ID: d.ID},
+			Addr:     *addr,
+		}
+		return m, &d, nil
+	}
+	wanted := func() (ok bool) {
+		s.exec(func() {
+			var cur DeviceConfig
+			cur, ok = s.configs[d.Addr]
+			ok = ok && reflect.DeepEqual(cur, d)
+		})
+		return
+	}
+	go s.registerUntil(resolve, policy, wanted)
+}
+
+// configFor returns the configuration of a discovered device, must run in exec
+func (s *Service) configFor(m MetadataAndAddr) *DeviceConfig {
+	for _, d := range s.configs {
+		if d.ID != "" && d.ID == m.ID {
+			return &d
+		}
+		if d.Addr == m.Addr.String() {
+			return &d
+		}
+	}
+	return nil
+}
+
+// applyDeviceConfig sets the configured attributes after ctx connects
+func (s *Service) applyDeviceConfig(ctx *DeviceContext) {
+	d := ctx.config
+	if d == nil {
+		return
+	}
+	for _, name := range sortedKeys(d.Set) {
+		if err := ctx.Set(name, d.Set[name]); err != nil {
+			s.deviceLog(ctx).Warn("unable to apply configured attribute", "attr", name, "err", err)
+		}
+	}
+	for _, name := range sortedKeys(d.SetOnDisconnect) {
+		if err := ctx.SetOnDisconnect(name, d.SetOnDisconnect[name]); err != nil {
+			s.deviceLog(ctx).Warn("unable to apply configured disconnect attribute", "attr", name, "err", err)
+		}
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,29 +1,40 @@
 package iotfwdrv
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pborges/iotfwdrv/proto"
 )
 
 var ErrNotConnected = errors.New("not connected")
+var ErrTimeout = errors.New("timeout awaiting response")
+var ErrDeviceClosed = errors.New("device closed")
+
+// DefaultTimeout is how long a Device waits for a response before it
+// considers the remote end unresponsive and drops the connection.
+const DefaultTimeout = 2 * time.Second
 
 func New(dialer func() (io.ReadWriteCloser, error)) *Device {
 	var dev Device
 
 	dev.execCh = make(chan func())
-	dev.inbound = make(chan string)
+	dev.stopped = make(chan struct{})
+	dev.inbound = make(chan proto.Packet)
 
 	dev.values = make(map[string]string)
+	dev.pending = make(map[uint64]*pendingRequest)
 	dev.dialer = dialer
-	dev.Log = log.New(ioutil.Discard, "[iotfwdrv] ", log.LstdFlags)
+	dev.Timeout = DefaultTimeout
 
 	go dev.execHandler()
 	return &dev
@@ -36,38 +47,78 @@ type Message struct {
 }
 
 type Device struct {
-	Log           *log.Logger
-	VerboseLog    bool
-	info          Metadata
-	connected     bool
-	dialer        func() (io.ReadWriteCloser, error)
-	execCh        chan func()
-	inbound       chan string
-	conn          io.ReadWriteCloser
-	setup         sync.Once
-	subscriptions []*Subscription
-	values        map[string]string
-	valuesLock    sync.Mutex
-	waiting       []chan error
-	lastRead      time.Time
+	Log               *slog.Logger
+	Timeout           time.Duration
+	Observer          Observer
+	info              Metadata
+	connected         atomic.Bool // written in exec, read from anywhere
+	dialer            func() (io.ReadWriteCloser, error)
+	execCh            chan func()
+	stopped           chan struct{}
+	closed            bool
+	reading           bool
+	inbound           chan proto.Packet
+	encoder           *proto.Encoder
+	conn              io.ReadWriteCloser
+	setup             sync.Once
+	subscriptions     []*Subscription
+	subscriptionsLock sync.Mutex
+	values            map[string]string
+	attributes        map[string]AttributeDescriptor
+	attributeOrder    []string
+	valuesLock        sync.Mutex
+	waiting           []chan error
+	lastRead          time.Time
+	pipelined         bool
+	pending           map[uint64]*pendingRequest
+	pendingLock       sync.Mutex
+	nextRequestID     uint64
+}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// log returns dev.Log annotated with the device identity
+func (dev *Device) log() *slog.Logger {
+	l := dev.Log
+	if l == nil {
+		l = discardLogger
+	}
+	attrs := []interface{}{"id", dev.info.ID, "name", dev.info.Name}
+	if addr := dev.Addr(); addr != nil {
+		attrs = append(attrs, "addr", addr.String())
+	}
+	return l.With(attrs...)
 }
 
 func (dev *Device) Wait() error {
+	return dev.WaitContext(context.Background())
+}
+
+// WaitContext blocks until the device disconnects or ctx is done
+func (dev *Device) WaitContext(ctx context.Context) error {
 	var c chan error
-	dev.exec(func() {
-		if dev.connected {
-			c = make(chan error)
+	if err := dev.execContext(ctx, func() {
+		if dev.connected.Load() {
+			// buffered so the reader never blocks on a waiter that gave up
+			c = make(chan error, 1)
 			dev.waiting = append(dev.waiting, c)
 		}
-	})
-	if c != nil {
-		return <-c
+	}); err != nil {
+		return err
+	}
+	if c == nil {
+		return ErrNotConnected
+	}
+	select {
+	case err := <-c:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("wait: %w", ctx.Err())
 	}
-	return ErrNotConnected
 }
 
 func (dev *Device) Connected() bool {
-	return dev.connected
+	return dev.connected.Load()
 }
 
 func (dev *Device) Addr() *net.TCPAddr {
@@ -82,7 +133,7 @@ func (dev *Device) Addr() *net.TCPAddr {
 func (dev *Device) Disconnect() (err error) {
 	dev.exec(func() {
 		if dev.conn != nil {
-			dev.Log.Println("disconnect called manually")
+			dev.log().Info("disconnect called manually")
 			err = dev.conn.Close()
 			err = fmt.Errorf("manual disconnect err: %w", err)
 		}
@@ -90,9 +141,40 @@ func (dev *Device) Disconnect() (err error) {
 	return err
 }
 
-func (dev *Device) Connect() (err error) {
+// Close disconnects dev for good and stops its exec goroutine once the
+// connection is torn down, a closed Device cannot connect again. Every Device
+// returned by New should be closed when it is no longer used.
+func (dev *Device) Close() (err error) {
 	dev.exec(func() {
-		if dev.connected {
+		if dev.closed {
+			return
+		}
+		dev.closed = true
+		if dev.reading {
+			err = dev.conn.Close()
+		}
+	})
+	return err
+}
+
+func (dev *Device) Connect() error {
+	return dev.ConnectContext(context.Background())
+}
+
+// ConnectContext dials the device and performs the info/list/sub handshake,
+// the dial itself is bounded by the dialer passed to New
+func (dev *Device) ConnectContext(ctx context.Context) error {
+	var err error
+	if execErr := dev.execContext(ctx, func() {
+		if dev.connected.Load() {
+			return
+		}
+		if dev.closed {
+			err = ErrDeviceClosed
+			return
+		}
+		if err = ctx.Err(); err != nil {
+			err = fmt.Errorf("connect: %w", err)
 			return
 		}
 
@@ -103,28 +185,33 @@ func (dev *Device) Connect() (err error) {
 		dev.reader()
 
 		// get the info packet
-		if err = dev.getInfo(); err != nil {
-			dev.connected = false
+		if err = dev.getInfo(ctx); err != nil {
+			dev.connected.Store(false)
 			if dev.conn != nil {
 				dev.conn.Close()
 			}
 			return
 		}
-		dev.Log.SetPrefix("[" + dev.Info().ID + ":" + dev.Info().Name + "] ")
 
 		// subscribe to all
-		if _, err = dev.write(packet{Cmd: "sub", Args: map[string]string{"filter": "*"}}); err != nil {
-			dev.Log.Println("subscriptions not supported")
+		if _, err = dev.write(ctx, proto.Packet{Cmd: "sub", Args: map[string]string{"filter": "*"}}); err != nil {
+			dev.log().Warn("subscriptions not supported", "err", err)
 			err = nil
 		}
-		dev.Log.Println("connected")
-	})
-	return
+		dev.log().Info("connected")
+	}); execErr != nil {
+		return execErr
+	}
+	return err
 }
 
-func (dev *Device) getInfo() (err error) {
-	var res []packet
-	res, err = dev.write(packet{
+func (dev *Device) getInfo(ctx context.Context) (err error) {
+	// info is always lock-step, it is what tells us whether the firmware
+	// can do anything else
+	dev.pipelined = false
+
+	var res []proto.Packet
+	res, err = dev.write(ctx, proto.Packet{
 		Cmd: "info",
 	})
 	if err != nil {
@@ -132,19 +219,19 @@ func (dev *Device) getInfo() (err error) {
 	} else if len(res) <= 0 {
 		err = errors.New("unexpected info response length")
 	} else {
-		dev.info.ID = res[0].Args["id"]
-		dev.info.Model = res[0].Args["model"]
-		dev.info.HardwareVer, err = ParseVersion(res[0].Args["hw"])
-		if err != nil {
+		var info Metadata
+		if info, err = parseInfo(res[0]); err != nil {
 			return
 		}
-		dev.info.FirmwareVer, err = ParseVersion(res[0].Args["fw"])
-		if err != nil {
-			return
+		if info.Name == "" {
+			// older firmware only reports it as config.name in the list below
+			info.Name = dev.info.Name
 		}
+		dev.info = info
+		dev.pipelined = hasCap(res[0].Args["caps"], CapRequestID)
 	}
 
-	res, err = dev.write(packet{
+	res, err = dev.write(ctx, proto.Packet{
 		Cmd: "list",
 	})
 	if err != nil {
@@ -152,37 +239,78 @@ func (dev *Device) getInfo() (err error) {
 	} else if len(res) <= 0 {
 		err = errors.New("unexpected list response length")
 	} else {
+		dev.valuesLock.Lock()
+		dev.attributes = make(map[string]AttributeDescriptor)
+		dev.attributeOrder = make([]string, 0, len(res))
 		for _, p := range res {
 			switch p.Cmd {
 			case "attr":
 				if p.Args["name"] == "config.name" {
 					dev.info.Name = p.Args["value"]
 				}
-				dev.valuesLock.Lock()
 				dev.values[p.Args["name"]] = p.Args["value"]
-				dev.valuesLock.Unlock()
+				if _, ok := dev.attributes[p.Args["name"]]; !ok {
+					dev.attributeOrder = append(dev.attributeOrder, p.Args["name"])
+				}
+				dev.attributes[p.Args["name"]] = newAttributeDescriptor(p.Args)
 			}
 		}
+		dev.valuesLock.Unlock()
 	}
 	return
 }
 
-func (dev *Device) synchronousWrite(cmd packet) (res []packet, err error) {
-	dev.exec(func() {
-		res, err = dev.write(cmd)
-	})
-	return
+func (dev *Device) synchronousWrite(ctx context.Context, cmd proto.Packet) ([]proto.Packet, error) {
+	// the closure may outlive this call if ctx is done first, so it only
+	// touches locals that are read after execContext reports completion
+	var res []proto.Packet
+	var err error
+	var id uint64
+	var req *pendingRequest
+	if execErr := dev.execContext(ctx, func() {
+		// the caller may already have given up, a command it was told failed
+		// must never reach the device
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = fmt.Errorf("%s: %w", cmd.Cmd, ctxErr)
+			return
+		}
+		if dev.pipelined {
+			id, req, err = dev.send(cmd)
+			return
+		}
+		res, err = dev.write(ctx, cmd)
+	}); execErr != nil {
+		return nil, execErr
+	}
+	if req != nil {
+		start := time.Now()
+		res, err = dev.await(ctx, id, req)
+		dev.observeWrite(cmd.Cmd, start, err)
+	}
+	return res, err
+}
+
+func (dev *Device) SetName(value string) error {
+	return dev.SetNameContext(context.Background(), value)
 }
 
-func (dev *Device) SetName(value string) (err error) {
-	if err := dev.Set("config.name", value); err == nil {
+func (dev *Device) SetNameContext(ctx context.Context, value string) error {
+	err := dev.SetContext(ctx, "config.name", value)
+	if err == nil {
 		dev.info.Name = value
 	}
 	return err
 }
 
-func (dev *Device) Set(name string, value interface{}) (err error) {
-	_, err = dev.synchronousWrite(packet{
+func (dev *Device) Set(name string, value interface{}) error {
+	return dev.SetContext(context.Background(), name, value)
+}
+
+func (dev *Device) SetContext(ctx context.Context, name string, value interface{}) (err error) {
+	if err = dev.validate(name, fmt.Sprint(value)); err != nil {
+		return
+	}
+	_, err = dev.synchronousWrite(ctx, proto.Packet{
 		Cmd: "set",
 		Args: map[string]string{
 			"name":  name,
@@ -204,8 +332,12 @@ type Response struct {
 	Debug  []string
 }
 
-func (dev *Device) Execute(name string, args map[string]interface{}) (res Response, err error) {
-	cmd := packet{
+func (dev *Device) Execute(name string, args map[string]interface{}) (Response, error) {
+	return dev.ExecuteContext(context.Background(), name, args)
+}
+
+func (dev *Device) ExecuteContext(ctx context.Context, name string, args map[string]interface{}) (res Response, err error) {
+	cmd := proto.Packet{
 		Cmd:  name,
 		Args: map[string]string{},
 	}
@@ -214,8 +346,8 @@ func (dev *Device) Execute(name string, args map[string]interface{}) (res Respon
 			cmd.Args[k] = fmt.Sprint(v)
 		}
 	}
-	var r []packet
-	r, err = dev.synchronousWrite(cmd)
+	var r []proto.Packet
+	r, err = dev.synchronousWrite(ctx, cmd)
 	for _, v := range r {
 		if v.Cmd == "output" {
 			res.Output = append(res.Output, v.Args["msg"])
@@ -230,8 +362,15 @@ func (dev *Device) Info() Metadata {
 	return dev.info
 }
 
-func (dev *Device) SetOnDisconnect(name string, value interface{}) (err error) {
-	_, err = dev.synchronousWrite(packet{
+func (dev *Device) SetOnDisconnect(name string, value interface{}) error {
+	return dev.SetOnDisconnectContext(context.Background(), name, value)
+}
+
+func (dev *Device) SetOnDisconnectContext(ctx context.Context, name string, value interface{}) (err error) {
+	if err = dev.validate(name, fmt.Sprint(value)); err != nil {
+		return
+	}
+	_, err = dev.synchronousWrite(ctx, proto.Packet{
 		Cmd: "set",
 		Args: map[string]string{
 			"name":       name,
@@ -243,113 +382,165 @@ func (dev *Device) SetOnDisconnect(name string, value interface{}) (err error) {
 }
 
 func (dev *Device) reader() {
-	var line string
 	var err error
 
-	reader := bufio.NewReader(dev.conn)
-	dev.connected = true
+	decoder := proto.NewDecoder(dev.conn)
+	dev.encoder = proto.NewEncoder(dev.conn)
+	dev.connected.Store(true)
+	dev.reading = true
 	go func() {
 		defer func() {
+			dev.failPending(err)
 			dev.exec(func() {
-				dev.connected = false
+				dev.connected.Store(false)
+				dev.reading = false
 				// close all subscriptions
-				for _, sub := range dev.subscriptions {
-					// dont call sub.Close() while iterating
-					close(sub.ch)
-				}
+				dev.subscriptionsLock.Lock()
+				subs := dev.subscriptions
 				dev.subscriptions = make([]*Subscription, 0)
+				dev.subscriptionsLock.Unlock()
+				for _, sub := range subs {
+					sub.shutdown(fmt.Errorf("%w: %v", ErrDisconnected, err))
+				}
 				for _, w := range dev.waiting {
 					w <- err
 					close(w)
 				}
 				dev.waiting = make([]chan error, 0)
-				dev.Log.Println("disconnected", err)
+				dev.log().Info("disconnected", "err", err)
 			})
 		}()
 
 		for {
-			line, err = reader.ReadString('\n')
+			var p proto.Packet
+			p, err = decoder.Decode()
 			if err != nil {
+				var syntaxErr *proto.SyntaxError
+				if errors.As(err, &syntaxErr) {
+					dev.log().Warn("err decoding packet", "err", err, "line", decoder.Line())
+					continue
+				}
 				err = fmt.Errorf("unable to read %w", err)
 				return
 			}
 			dev.lastRead = time.Now()
-			line = strings.TrimSpace(line)
-			if dev.VerboseLog {
-				dev.Log.Println("read:", line)
-			}
-			line = strings.TrimSpace(line)
-			if !strings.HasPrefix(line, "@") {
-				dev.inbound <- line
+			dev.log().Debug("read", "cmd", p.Cmd, "line", decoder.Line())
+			if !strings.HasPrefix(p.Cmd, "@") {
+				if !dev.route(p) {
+					dev.inbound <- p
+				}
 			} else {
-				cmd, err := decode(line)
-				if err == nil {
-					switch cmd.Cmd {
-					case "@attr":
-						dev.valuesLock.Lock()
-						dev.values[cmd.Args["name"]] = cmd.Args["value"]
-						if cmd.Args["name"] == "config.name" {
-							info := dev.info
-							info.Name = cmd.Args["value"]
-							dev.info = info
-						}
-						dev.valuesLock.Unlock()
-
-						dev.fanout(cmd.Args["name"], cmd.Args["value"])
+				switch p.Cmd {
+				case "@attr":
+					dev.valuesLock.Lock()
+					dev.values[p.Args["name"]] = p.Args["value"]
+					if p.Args["name"] == "config.name" {
+						info := dev.info
+						info.Name = p.Args["value"]
+						dev.info = info
 					}
-				} else {
-					dev.Log.Println("err decoding aync packet:", line)
+					dev.valuesLock.Unlock()
+
+					dev.fanout(p.Args["name"], p.Args["value"])
 				}
 			}
 		}
 	}()
 }
 
+// execHandler runs exec functions until dev is closed and its reader is done
 func (dev *Device) execHandler() {
+	defer close(dev.stopped)
 	for {
 		select {
 		case fn := <-dev.execCh:
 			fn()
+			if dev.closed && !dev.reading {
+				return
+			}
 		case <-time.After(1 * time.Second):
 			if time.Since(dev.lastRead) > 10*time.Second {
-				_, _ = dev.write(packet{Cmd: "ping"})
+				_, _ = dev.write(context.Background(), proto.Packet{Cmd: "ping"})
 			}
 		}
 	}
 }
 
+// exec runs fn in the exec goroutine, fn is skipped once dev is closed
 func (dev *Device) exec(fn func()) {
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	dev.execCh <- func() {
+	done := make(chan struct{})
+	select {
+	case dev.execCh <- func() {
+		fn()
+		close(done)
+	}:
+		<-done
+	case <-dev.stopped:
+	}
+}
+
+// execContext is exec that gives up waiting once ctx is done, fn may still
+// be queued or running when it returns ctx.Err(). It returns ErrDeviceClosed
+// without running fn once dev is closed.
+func (dev *Device) execContext(ctx context.Context, fn func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	select {
+	case dev.execCh <- func() {
 		fn()
-		wg.Done()
+		close(done)
+	}:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-dev.stopped:
+		return ErrDeviceClosed
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// responseTimeout is how long to wait for an answer before giving up on the
+// connection, the larger of dev.Timeout and whatever is left on ctx
+func (dev *Device) responseTimeout(ctx context.Context) time.Duration {
+	timeout := dev.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) > timeout {
+		timeout = time.Until(deadline)
 	}
-	wg.Wait()
+	return timeout
 }
 
-func (dev *Device) write(cmd packet) (res []packet, err error) {
-	if !dev.connected {
+func (dev *Device) write(ctx context.Context, cmd proto.Packet) (res []proto.Packet, err error) {
+	if !dev.connected.Load() {
 		err = ErrNotConnected
 		return
 	}
-	encoded := encode(cmd)
-	if dev.VerboseLog {
-		dev.Log.Println("write:", encoded)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		err = fmt.Errorf("%s: %w", cmd.Cmd, ctxErr)
+		return
 	}
-	_, err = fmt.Fprintln(dev.conn, encoded)
+	dev.log().Debug("write", "cmd", cmd.Cmd, "line", cmd.String())
+	defer func(start time.Time) {
+		dev.observeWrite(cmd.Cmd, start, err)
+	}(time.Now())
+	err = dev.encoder.Encode(cmd)
 	if err != nil {
 		err = fmt.Errorf("unable to write data %w", err)
 		return
 	}
+	timeout := time.NewTimer(dev.responseTimeout(ctx))
+	defer timeout.Stop()
 	for {
 		select {
-		case line := <-dev.inbound:
-			var p packet
-			p, err = decode(line)
-			if err != nil {
-				return
-			}
+		case p := <-dev.inbound:
 			switch p.Cmd {
 			case "ok":
 				return
@@ -359,8 +550,29 @@ func (dev *Device) write(cmd packet) (res []packet, err error) {
 			default:
 				res = append(res, p)
 			}
-		case <-time.After(2 * time.Second):
-			err = errors.New("timeout awaiting response")
+		case <-ctx.Done():
+			err = fmt.Errorf("%s: %w", cmd.Cmd, ctx.Err())
+			dev.drain(timeout.C)
+			return
+		case <-timeout.C:
+			err = ErrTimeout
+			dev.conn.Close()
+			return
+		}
+	}
+}
+
+// drain discards the rest of an abandoned response so it is not mistaken for
+// the answer to the next command, if the device does not finish answering
+// before expired fires it is considered dead and the connection is closed
+func (dev *Device) drain(expired <-chan time.Time) {
+	for {
+		select {
+		case p := <-dev.inbound:
+			if p.Cmd == "ok" || p.Cmd == "err" {
+				return
+			}
+		case <-expired:
 			dev.conn.Close()
 			return
 		}
@@ -368,35 +580,78 @@ func (dev *Device) write(cmd packet) (res []packet, err error) {
 }
 
 func (dev *Device) fanout(key string, value string) {
-	slowSubscribers := make([]*Subscription, 0, len(dev.subscriptions))
+	dev.subscriptionsLock.Lock()
+	subs := make([]*Subscription, 0, len(dev.subscriptions))
 	for _, sub := range dev.subscriptions {
-		if KeyMatch(key, sub.filter) {
-			select {
-			case sub.ch <- Message{
-				Device: dev.info,
-				Key:    key,
-				Value:  value,
-			}:
-			default:
-				slowSubscribers = append(slowSubscribers, sub)
-			}
+		if sub.match(key) {
+			subs = append(subs, sub)
 		}
 	}
-	for _, sub := range slowSubscribers {
-		sub.Close()
-		dev.Log.Println("closing slow subscriber", sub)
+	dev.subscriptionsLock.Unlock()
+
+	for _, sub := range subs {
+		if !sub.deliver(Message{
+			Device: dev.info,
+			Key:    key,
+			Value:  value,
+		}) {
+			sub.closeWithErr(ErrSlowSubscriber)
+			dev.log().Warn("closing slow subscriber", "filter", sub.Filter(), "dropped", sub.Dropped())
+			if dev.Observer != nil {
+				dev.Observer.ObserveSlowSubscriber(sub.Filter())
+			}
+		}
 	}
 }
 
+func (dev *Device) unsubscribe(sub *Subscription) {
+	dev.subscriptionsLock.Lock()
+	defer dev.subscriptionsLock.Unlock()
+	dev.subscriptions = removeSubscription(dev.subscriptions, sub)
+}
+
 func (dev *Device) Subscribe(filter string) *Subscription {
-	sub := &Subscription{
-		device: dev,
-		filter: filter,
-		ch:     make(chan Message, 10),
+	return dev.SubscribeWithOptions(filter, SubscribeOptions{})
+}
+
+func (dev *Device) SubscribeWithOptions(filter string, opts SubscribeOptions) *Subscription {
+	sub := newSubscription(dev, filter, opts)
+
+	// hold the values while registering so no update lands between the
+	// snapshot and the first live message
+	dev.valuesLock.Lock()
+	defer dev.valuesLock.Unlock()
+
+	var snapshot []Message
+	if opts.Replay {
+		snapshot = dev.snapshot("", sub.match)
 	}
-	dev.exec(func() {
-		sub.execCh = dev.execCh
-		dev.subscriptions = append(dev.subscriptions, sub)
-	})
+	sub.open(snapshot, dev.info)
+
+	dev.subscriptionsLock.Lock()
+	dev.subscriptions = append(dev.subscriptions, sub)
+	dev.subscriptionsLock.Unlock()
 	return sub
 }
+
+// snapshot returns the cached values whose prefixed key matches, sorted by
+// key, dev.valuesLock must be held
+func (dev *Device) snapshot(prefix string, match func(key string) bool) []Message {
+	keys := make([]string, 0, len(dev.values))
+	for attr := range dev.values {
+		if match(prefix + attr) {
+			keys = append(keys, attr)
+		}
+	}
+	sort.Strings(keys)
+
+	msgs := make([]Message, 0, len(keys))
+	for _, attr := range keys {
+		msgs = append(msgs, Message{
+			Device: dev.info,
+			Key:    prefix + attr,
+			Value:  dev.values[attr],
+		})
+	}
+	return msgs
+}
@@ -0,0 +1,87 @@
+package iotfwdrv_test
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pborges/iotfwdrv"
+	"github.com/pborges/iotfwdrv/iotfwtest"
+)
+
+// connect returns a Device connected to fake over net.Pipe, closed when the
+// test ends
+func connect(t *testing.T, fake *iotfwtest.Device) *iotfwdrv.Device {
+	t.Helper()
+	dev := iotfwdrv.New(fake.Dialer())
+	t.Cleanup(func() {
+		dev.Close()
+	})
+	if err := dev.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return dev
+}
+
+// settle waits for the goroutine count to drop back to at most n
+func settle(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, want at most %d", runtime.NumGoroutine(), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeviceClose(t *testing.T) {
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	before := runtime.NumGoroutine()
+
+	dev := iotfwdrv.New(fake.Dialer())
+	if err := dev.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	waited := make(chan error, 1)
+	go func() {
+		waited <- dev.Wait()
+	}()
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatal("Wait did not return after Close")
+	}
+	if dev.Connected() {
+		t.Fatal("connected after Close")
+	}
+	if err := dev.Connect(); !errors.Is(err, iotfwdrv.ErrDeviceClosed) {
+		t.Fatalf("Connect after Close = %v, want ErrDeviceClosed", err)
+	}
+	if err := dev.Set("config.name", "x"); !errors.Is(err, iotfwdrv.ErrDeviceClosed) {
+		t.Fatalf("Set after Close = %v, want ErrDeviceClosed", err)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatalf("second Close = %v", err)
+	}
+	settle(t, before)
+}
+
+func TestDeviceCloseUnreachable(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		dev := iotfwdrv.New(func() (io.ReadWriteCloser, error) {
+			return nil, errors.New("unreachable")
+		})
+		if err := dev.Connect(); err == nil {
+			t.Fatal("connected to an unreachable device")
+		}
+		dev.Close()
+	}
+	settle(t, before)
+}
@@ -2,31 +2,41 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/pborges/iotfwdrv"
-	"log"
+	"log/slog"
 	"os"
+	"time"
 )
 
 func main() {
-	Logger := log.New(os.Stdout, "", log.LstdFlags|log.Lshortfile)
+	Logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{AddSource: true}))
 	svc := iotfwdrv.Service{
-		Log: Logger,
+		Log:            Logger,
+		Registry:       iotfwdrv.NewFileRegistry("devices.json"),
+		RegistryMaxAge: 7 * 24 * time.Hour,
 		OnConnect: func(ctx iotfwdrv.DeviceContext) {
 			ctx.Log = Logger
-			//ctx.VerboseLog = true
 
 			if ctx.Get("led.0") != "" {
 				if err := ctx.Set("led.0", true); err != nil {
-					Logger.Printf("unable to set %s:led.0 to true", ctx.Info().ID)
+					Logger.Error("unable to set led.0 to true", "id", ctx.Info().ID, "err", err)
 				}
 				if err := ctx.SetOnDisconnect("led.0", false); err != nil {
-					Logger.Printf("unable to set %s:led.0 to false on disconnect", ctx.Info().ID)
+					Logger.Error("unable to set led.0 to false on disconnect", "id", ctx.Info().ID, "err", err)
 				}
 			}
 		},
 	}
-	go svc.HandleMDNS()
+	go func() {
+		if err := svc.Restore(); err != nil {
+			Logger.Error("unable to restore devices", "err", err)
+		}
+	}()
+	if err := svc.HandleMDNS(context.Background()); err != nil {
+		Logger.Error("unable to start mdns discovery", "err", err)
+	}
 
 	go func() {
 		for m := range svc.Subscribe("*.@event").Chan() {
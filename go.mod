@@ -1,13 +1,31 @@
 module github.com/pborges/iotfwdrv
 
-go 1.15
+go 1.22
 
 require (
-	github.com/brutella/dnssd v1.2.0 // indirect
-	github.com/grandcat/zeroconf v1.0.0
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/miekg/dns v1.1.27
+	github.com/mochi-mqtt/server/v2 v2.6.6
 	github.com/olekukonko/tablewriter v0.0.4
+	github.com/prometheus/client_golang v1.19.1
 	github.com/spf13/cobra v1.1.3
-	golang.org/x/net v0.0.0-20210119194325-5f4716e94777
-	golang.org/x/sys v0.0.0-20210124154548-22da62e12c0c // indirect
-	google.golang.org/api v0.32.0
+	golang.org/x/net v0.23.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/mattn/go-runewidth v0.0.7 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	github.com/rs/xid v1.4.0 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/crypto v0.21.0 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,319 @@
+// Package httpapi exposes an iotfwdrv.Service as an HTTP/JSON API.
+//
+//	GET  /devices                          list devices with metadata and uptime
+//	GET  /devices/{id}                     a single device
+//	GET  /devices/{id}/attributes          every cached attribute value
+//	GET  /devices/{id}/attributes/{name}   a single attribute
+//	PUT  /devices/{id}/attributes/{name}   set an attribute, body {"value": ...}
+//	POST /devices/{id}/execute/{command}   run a command, body {"args": {...}}
+//	POST /scan                             scan the local networks and register
+//	GET  /events?filter=...&replay=true    Server-Sent Events of Service.Subscribe
+//	GET  /ws?filter=...&replay=true        the same stream over a WebSocket
+//
+// The stream filter takes the KeyMatch syntax against <id>.<attr> keys.
+//
+// Errors are returned as {"error": {"code": "...", "message": "..."}}.
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pborges/iotfwdrv"
+)
+
+type Handler struct {
+	Service *iotfwdrv.Service
+	mux     *http.ServeMux
+}
+
+func NewHandler(svc *iotfwdrv.Service) *Handler {
+	h := &Handler{
+		Service: svc,
+		mux:     http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /devices", h.listDevices)
+	h.mux.HandleFunc("GET /devices/{id}", h.getDevice)
+	h.mux.HandleFunc("GET /devices/{id}/attributes", h.getAttributes)
+	h.mux.HandleFunc("GET /devices/{id}/attributes/{name}", h.getAttribute)
+	h.mux.HandleFunc("PUT /devices/{id}/attributes/{name}", h.setAttribute)
+	h.mux.HandleFunc("POST /devices/{id}/execute/{command}", h.execute)
+	h.mux.HandleFunc("POST /scan", h.scan)
+	h.mux.HandleFunc("GET /events", h.events)
+	h.mux.HandleFunc("GET /ws", h.stream)
+	h.mux.HandleFunc("/", h.notFound)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+var methods = []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete, http.MethodPatch}
+
+// notFound answers what no route takes, a path served under other methods
+// gets a 405 listing them as the catch-all would otherwise hide it
+func (h *Handler) notFound(w http.ResponseWriter, r *http.Request) {
+	var allowed []string
+	for _, method := range methods {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		if _, pattern := h.mux.Handler(probe); pattern != "/" {
+			allowed = append(allowed, method)
+		}
+	}
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("%s is not allowed, use %s", r.Method, strings.Join(allowed, " or ")))
+		return
+	}
+	writeError(w, http.StatusNotFound, "not_found", "no such endpoint")
+}
+
+type Device struct {
+	ID                string           `json:"id"`
+	Name              string           `json:"name"`
+	Alias             string           `json:"alias,omitempty"`
+	Model             string           `json:"model"`
+	HardwareVer       iotfwdrv.Version `json:"hardware_version"`
+	FirmwareVer       iotfwdrv.Version `json:"firmware_version"`
+	Addr              string           `json:"addr,omitempty"`
+	Connected         bool             `json:"connected"`
+	ConnectedAt       *time.Time       `json:"connected_at,omitempty"`
+	UptimeSeconds     float64          `json:"uptime_seconds,omitempty"`
+	ReconnectAttempts int              `json:"reconnect_attempts,omitempty"`
+	NextReconnectAt   *time.Time       `json:"next_reconnect_at,omitempty"`
+}
+
+func newDevice(ctx iotfwdrv.DeviceContext) Device {
+	info := ctx.Info()
+	d := Device{
+		ID:                info.ID,
+		Name:              info.Name,
+		Alias:             ctx.Alias,
+		Model:             info.Model,
+		HardwareVer:       info.HardwareVer,
+		FirmwareVer:       info.FirmwareVer,
+		Connected:         ctx.Connected(),
+		ReconnectAttempts: ctx.ReconnectAttempts,
+	}
+	if addr := ctx.Addr(); addr != nil {
+		d.Addr = addr.String()
+	}
+	if d.Connected && !ctx.ConnectedAt.IsZero() {
+		connectedAt := ctx.ConnectedAt
+		d.ConnectedAt = &connectedAt
+		d.UptimeSeconds = time.Since(connectedAt).Seconds()
+	}
+	if !ctx.NextReconnectAt.IsZero() {
+		next := ctx.NextReconnectAt
+		d.NextReconnectAt = &next
+	}
+	return d
+}
+
+type Attribute struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type setRequest struct {
+	Value interface{} `json:"value"`
+}
+
+type executeRequest struct {
+	Args map[string]interface{} `json:"args"`
+}
+
+type executeResponse struct {
+	Output []string `json:"output"`
+	Debug  []string `json:"debug"`
+}
+
+type scanResponse struct {
+	Devices []Device `json:"devices"`
+	Errors  int      `json:"errors"`
+}
+
+type errorBody struct {
+	Error struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (h *Handler) listDevices(w http.ResponseWriter, r *http.Request) {
+	ctxs := h.Service.DeviceContexts()
+	devs := make([]Device, 0, len(ctxs))
+	for _, ctx := range ctxs {
+		devs = append(devs, newDevice(ctx))
+	}
+	writeJSON(w, http.StatusOK, devs)
+}
+
+func (h *Handler) getDevice(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := h.device(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, newDevice(ctx))
+}
+
+func (h *Handler) getAttributes(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := h.device(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, ctx.Values())
+}
+
+func (h *Handler) getAttribute(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := h.device(w, r)
+	if !ok {
+		return
+	}
+	name := r.PathValue("name")
+	value, ok := ctx.Lookup(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "attribute_not_found", fmt.Sprintf("device %s has no attribute %s", ctx.Info().ID, name))
+		return
+	}
+	writeJSON(w, http.StatusOK, Attribute{Name: name, Value: value})
+}
+
+func (h *Handler) setAttribute(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := h.device(w, r)
+	if !ok {
+		return
+	}
+	var req setRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+		return
+	}
+	if req.Value == nil {
+		writeError(w, http.StatusBadRequest, "bad_request", "value is required")
+		return
+	}
+	if !scalar(req.Value) {
+		writeError(w, http.StatusBadRequest, "invalid_value", "value must be a string, number or bool")
+		return
+	}
+	name := r.PathValue("name")
+	if err := ctx.SetContext(r.Context(), name, req.Value); err != nil {
+		writeDeviceError(w, err)
+		return
+	}
+	// the cached value only catches up once the device reports the change,
+	// answer with what was sent instead
+	writeJSON(w, http.StatusOK, Attribute{Name: name, Value: fmt.Sprint(req.Value)})
+}
+
+func (h *Handler) execute(w http.ResponseWriter, r *http.Request) {
+	ctx, ok := h.device(w, r)
+	if !ok {
+		return
+	}
+	var req executeRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r, &req); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", err.Error())
+			return
+		}
+	}
+	for k, v := range req.Args {
+		if !scalar(v) {
+			writeError(w, http.StatusBadRequest, "invalid_value", fmt.Sprintf("arg %s must be a string, number or bool", k))
+			return
+		}
+	}
+	res, err := ctx.ExecuteContext(r.Context(), r.PathValue("command"), req.Args)
+	if err != nil {
+		writeDeviceError(w, err)
+		return
+	}
+	out := executeResponse{Output: res.Output, Debug: res.Debug}
+	if out.Output == nil {
+		out.Output = []string{}
+	}
+	if out.Debug == nil {
+		out.Debug = []string{}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (h *Handler) scan(w http.ResponseWriter, r *http.Request) {
+	err := h.Service.ScanAndRegisterContext(r.Context())
+	res := scanResponse{Devices: []Device{}}
+	var ipErrs iotfwdrv.IPErrors
+	if errors.As(err, &ipErrs) {
+		// unanswered addresses are expected, only report how many
+		res.Errors = len(ipErrs)
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "scan_failed", err.Error())
+		return
+	}
+	for _, ctx := range h.Service.DeviceContexts() {
+		res.Devices = append(res.Devices, newDevice(ctx))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// decodeJSON decodes the request body keeping numbers as written, a float64
+// would reach the device as 1e+06
+func decodeJSON(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// scalar reports whether v decoded from a JSON string, number or bool, the
+// only values the line protocol can carry
+func scalar(v interface{}) bool {
+	switch v.(type) {
+	case string, json.Number, bool:
+		return true
+	}
+	return false
+}
+
+func (h *Handler) device(w http.ResponseWriter, r *http.Request) (iotfwdrv.DeviceContext, bool) {
+	id := r.PathValue("id")
+	ctx, ok := h.Service.DeviceContext(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "device_not_found", fmt.Sprintf("no device %s", id))
+	}
+	return ctx, ok
+}
+
+func writeDeviceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, iotfwdrv.ErrInvalidValue):
+		writeError(w, http.StatusBadRequest, "invalid_value", err.Error())
+	case errors.Is(err, iotfwdrv.ErrReadOnly):
+		writeError(w, http.StatusForbidden, "read_only", err.Error())
+	case errors.Is(err, iotfwdrv.ErrNotConnected):
+		writeError(w, http.StatusServiceUnavailable, "not_connected", err.Error())
+	case errors.Is(err, iotfwdrv.ErrTimeout):
+		writeError(w, http.StatusGatewayTimeout, "timeout", err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, "device_error", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string, msg string) {
+	var body errorBody
+	body.Error.Code = code
+	body.Error.Message = msg
+	writeJSON(w, status, body)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,102 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pborges/iotfwdrv"
+	"github.com/pborges/iotfwdrv/iotfwtest"
+)
+
+func newTestHandler(t *testing.T) (*Handler, *iotfwtest.Device) {
+	t.Helper()
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	fake.SetAttr("relay.0", "false")
+	addr, err := fake.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fake.Close()
+	})
+	svc := &iotfwdrv.Service{ReconnectPolicy: iotfwdrv.ConstantBackoff{Delay: time.Hour}}
+	svc.Register(iotfwdrv.MetadataAndAddr{Metadata: fake.Metadata(), Addr: *addr})
+	if dev := svc.Device("dev1"); dev == nil || !dev.Connected() {
+		t.Fatal("fake device not registered")
+	}
+	return NewHandler(svc), fake
+}
+
+func do(h *Handler, method string, path string, body string) (*httptest.ResponseRecorder, errorBody) {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+	var e errorBody
+	_ = json.Unmarshal(rec.Body.Bytes(), &e)
+	return rec, e
+}
+
+func TestSetAttributeValues(t *testing.T) {
+	h, fake := newTestHandler(t)
+
+	for _, body := range []string{`{"value":{"x":1}}`, `{"value":[1,2]}`} {
+		rec, e := do(h, http.MethodPut, "/devices/dev1/attributes/relay.0", body)
+		if rec.Code != http.StatusBadRequest || e.Error.Code != "invalid_value" {
+			t.Fatalf("PUT %s = %d %q, want 400 invalid_value", body, rec.Code, e.Error.Code)
+		}
+	}
+	if v, _ := fake.Attr("relay.0"); v != "false" {
+		t.Fatalf("relay.0 = %q after rejected sets, want false", v)
+	}
+
+	for body, want := range map[string]string{
+		`{"value":true}`:    "true",
+		`{"value":1000000}`: "1000000",
+		`{"value":"on"}`:    "on",
+	} {
+		rec, _ := do(h, http.MethodPut, "/devices/dev1/attributes/relay.0", body)
+		var attr Attribute
+		if err := json.Unmarshal(rec.Body.Bytes(), &attr); err != nil || rec.Code != http.StatusOK || attr.Value != want {
+			t.Fatalf("PUT %s = %d %s, want 200 with %s", body, rec.Code, rec.Body, want)
+		}
+		if v, _ := fake.Attr("relay.0"); v != want {
+			t.Fatalf("relay.0 = %q, want %s", v, want)
+		}
+	}
+
+	rec, e := do(h, http.MethodPost, "/devices/dev1/execute/reboot", `{"args":{"delay":{"s":5}}}`)
+	if rec.Code != http.StatusBadRequest || e.Error.Code != "invalid_value" {
+		t.Fatalf("execute with an object arg = %d %q, want 400 invalid_value", rec.Code, e.Error.Code)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	h, _ := newTestHandler(t)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		code   string
+		allow  string
+	}{
+		{http.MethodDelete, "/devices/dev1", http.StatusMethodNotAllowed, "method_not_allowed", "GET"},
+		{http.MethodPost, "/devices/dev1/attributes/relay.0", http.StatusMethodNotAllowed, "method_not_allowed", "GET, PUT"},
+		{http.MethodGet, "/scan", http.StatusMethodNotAllowed, "method_not_allowed", "POST"},
+		{http.MethodGet, "/nope", http.StatusNotFound, "not_found", ""},
+		{http.MethodDelete, "/nope", http.StatusNotFound, "not_found", ""},
+	}
+	for _, tt := range tests {
+		rec, e := do(h, tt.method, tt.path, "")
+		if rec.Code != tt.status || e.Error.Code != tt.code || rec.Header().Get("Allow") != tt.allow {
+			t.Errorf("%s %s = %d %q allow %q, want %d %q allow %q", tt.method, tt.path,
+				rec.Code, e.Error.Code, rec.Header().Get("Allow"), tt.status, tt.code, tt.allow)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s Content-Type = %q, want application/json", tt.method, tt.path, ct)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborges/iotfwdrv"
+	"golang.org/x/net/websocket"
+)
+
+// keepAliveInterval is how often an idle SSE stream sends a comment so
+// proxies do not time it out
+const keepAliveInterval = 15 * time.Second
+
+// Event is a message from Service.Subscribe as sent on /events and /ws, Key
+// is <id>.<attr> and a Key of iotfwdrv.KeySnapshot marks the end of a replay
+type Event struct {
+	ID    string `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func newEvent(m iotfwdrv.Message) Event {
+	return Event{
+		ID:    m.Device.ID,
+		Name:  m.Device.Name,
+		Key:   m.Key,
+		Value: m.Value,
+	}
+}
+
+// subscribe reads the stream query parameters, filter takes the KeyMatch
+// syntax and defaults to every key of every device, replay=true first sends
+// current values
+func (h *Handler) subscribe(w http.ResponseWriter, r *http.Request) (*iotfwdrv.Subscription, bool) {
+	q := r.URL.Query()
+	filter := q.Get("filter")
+	if filter == "" {
+		filter = ">"
+	}
+	var replay bool
+	if v := q.Get("replay"); v != "" {
+		var err error
+		if replay, err = strconv.ParseBool(v); err != nil {
+			writeError(w, http.StatusBadRequest, "bad_request", fmt.Sprintf("replay: %s", err))
+			return nil, false
+		}
+	}
+	// a browser that falls behind only cares about the latest value of each key
+	sub := h.Service.SubscribeWithOptions(filter, iotfwdrv.SubscribeOptions{
+		Replay:     replay,
+		SlowPolicy: iotfwdrv.SlowCoalesce,
+	})
+	return sub, true
+}
+
+// events streams subscription messages as Server-Sent Events
+func (h *Handler) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming_unsupported", "response writer cannot stream")
+		return
+	}
+	sub, ok := h.subscribe(w, r)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case m, ok := <-sub.Chan():
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(newEvent(m))
+			if err != nil {
+				return
+			}
+			name := "attr"
+			if m.Key == iotfwdrv.KeySnapshot {
+				name = "snapshot"
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// stream upgrades to a WebSocket and sends each subscription message as a
+// JSON Event, anything the client sends is ignored
+func (h *Handler) stream(w http.ResponseWriter, r *http.Request) {
+	sub, ok := h.subscribe(w, r)
+	if !ok {
+		return
+	}
+	defer sub.Close()
+
+	websocket.Server{Handshake: checkOrigin, Handler: func(ws *websocket.Conn) {
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+		for {
+			select {
+			case <-closed:
+				return
+			case m, ok := <-sub.Chan():
+				if !ok {
+					return
+				}
+				if err := websocket.JSON.Send(ws, newEvent(m)); err != nil {
+					return
+				}
+			}
+		}
+	}}.ServeHTTP(w, r)
+}
+
+// checkOrigin accepts clients that send no Origin, such as command line tools,
+// and pages served from this host. Any other page a user has open could
+// otherwise read the device stream.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	if origin != nil && !strings.EqualFold(origin.Host, r.Host) {
+		return fmt.Errorf("origin %s not allowed", origin)
+	}
+	config.Origin = origin
+	return nil
+}
@@ -0,0 +1,341 @@
+// Package iotfwtest provides a scriptable in-process iotfw device that speaks
+// the line protocol, so code built on iotfwdrv.New can be tested without
+// hardware.
+package iotfwtest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pborges/iotfwdrv"
+	"github.com/pborges/iotfwdrv/proto"
+)
+
+// Handler answers a command, the returned packets are written before the
+// terminating ok, a non nil error is sent as err msg:<error> instead
+type Handler func(args map[string]string) ([]proto.Packet, error)
+
+// Device is a fake iotfw device, attributes and handlers may be changed at
+// any time including while clients are connected
+type Device struct {
+	ID          string
+	Model       string
+	HardwareVer string
+	FirmwareVer string
+	// Pipelining advertises the rid capability, commands carrying a rid are
+	// then handled concurrently and every response line is tagged with it
+	Pipelining bool
+
+	mu       sync.Mutex
+	attrs    map[string]string
+	meta     map[string]map[string]string
+	order    []string
+	handlers map[string]Handler
+	conns    map[*conn]struct{}
+	listener net.Listener
+}
+
+// NewDevice creates a fake device with the given id and a config.name attribute
+func NewDevice(id string, name string) *Device {
+	d := &Device{
+		ID:          id,
+		Model:       "iotfwtest",
+		HardwareVer: "1.0",
+		FirmwareVer: "1.0",
+		attrs:       make(map[string]string),
+		meta:        make(map[string]map[string]string),
+		handlers:    make(map[string]Handler),
+		conns:       make(map[*conn]struct{}),
+	}
+	d.SetAttr("config.name", name)
+	return d
+}
+
+// Handle registers a handler for cmd, replacing any built in behaviour
+func (d *Device) Handle(cmd string, h Handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if h == nil {
+		delete(d.handlers, cmd)
+		return
+	}
+	d.handlers[cmd] = h
+}
+
+// Attr returns the current value of an attribute
+func (d *Device) Attr(name string) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v, ok := d.attrs[name]
+	return v, ok
+}
+
+// SetAttr changes an attribute and pushes an @attr to every subscribed client
+func (d *Device) SetAttr(name string, value string) {
+	d.mu.Lock()
+	if _, ok := d.attrs[name]; !ok {
+		d.order = append(d.order, name)
+	}
+	d.attrs[name] = value
+	conns := d.connList()
+	d.mu.Unlock()
+
+	push := proto.Packet{Cmd: "@attr", Args: map[string]string{"name": name, "value": value}}
+	for _, c := range conns {
+		if c.subscribed(name) {
+			_ = c.send(push)
+		}
+	}
+}
+
+// Describe sets extra arguments sent with the attribute in the list
+// response, such as type, ro, min, max, unit or desc
+func (d *Device) Describe(name string, args map[string]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.meta[name] = args
+}
+
+// Push writes an arbitrary async packet to every connected client
+func (d *Device) Push(p proto.Packet) {
+	d.mu.Lock()
+	conns := d.connList()
+	d.mu.Unlock()
+	for _, c := range conns {
+		_ = c.send(p)
+	}
+}
+
+// Conns returns the number of connected clients
+func (d *Device) Conns() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+// Drop closes every client connection, simulating the device going away,
+// attributes set with disconnect:true are applied as each connection closes
+func (d *Device) Drop() {
+	d.mu.Lock()
+	conns := d.connList()
+	d.mu.Unlock()
+	for _, c := range conns {
+		_ = c.rwc.Close()
+	}
+}
+
+// Dialer returns a dialer for iotfwdrv.New that serves each dial over net.Pipe
+func (d *Device) Dialer() func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		client, server := net.Pipe()
+		go d.Serve(server)
+		return client, nil
+	}
+}
+
+// Listen accepts connections on addr until Close is called, use
+// "127.0.0.1:0" to pick a free port
+func (d *Device) Listen(addr string) (*net.TCPAddr, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.listener = l
+	d.mu.Unlock()
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go d.Serve(c)
+		}
+	}()
+	return l.Addr().(*net.TCPAddr), nil
+}
+
+// Metadata is what a driver connected to this device should report
+func (d *Device) Metadata() iotfwdrv.Metadata {
+	name, _ := d.Attr("config.name")
+	m := iotfwdrv.Metadata{
+		ID:    d.ID,
+		Name:  name,
+		Model: d.Model,
+	}
+	m.HardwareVer, _ = iotfwdrv.ParseVersion(d.HardwareVer)
+	m.FirmwareVer, _ = iotfwdrv.ParseVersion(d.FirmwareVer)
+	return m
+}
+
+// Close stops listening and drops every client
+func (d *Device) Close() error {
+	d.mu.Lock()
+	l := d.listener
+	d.listener = nil
+	d.mu.Unlock()
+
+	var err error
+	if l != nil {
+		err = l.Close()
+	}
+	d.Drop()
+	return err
+}
+
+// Serve speaks the protocol on rwc until it is closed
+func (d *Device) Serve(rwc io.ReadWriteCloser) {
+	c := &conn{rwc: rwc, encoder: proto.NewEncoder(rwc), onDisconnect: make(map[string]string)}
+	d.mu.Lock()
+	d.conns[c] = struct{}{}
+	d.mu.Unlock()
+
+	defer func() {
+		_ = rwc.Close()
+		d.mu.Lock()
+		delete(d.conns, c)
+		d.mu.Unlock()
+		c.mu.Lock()
+		onDisconnect := c.onDisconnect
+		c.onDisconnect = nil
+		c.mu.Unlock()
+		for name, value := range onDisconnect {
+			d.SetAttr(name, value)
+		}
+	}()
+
+	decoder := proto.NewDecoder(rwc)
+	for {
+		p, err := decoder.Decode()
+		if err != nil {
+			var syntaxErr *proto.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				if c.send(errPacket(err)) != nil {
+					return
+				}
+				continue
+			}
+			return
+		}
+		if p.ID != 0 && d.Pipelining {
+			go d.respond(c, p)
+			continue
+		}
+		p.ID = 0
+		if d.respond(c, p) != nil {
+			return
+		}
+	}
+}
+
+// respond runs p and writes the response, tagging each line with p.ID if set
+func (d *Device) respond(c *conn, p proto.Packet) error {
+	res, err := d.dispatch(c, p)
+	if err != nil {
+		res = append(res, errPacket(err))
+	} else {
+		res = append(res, proto.Packet{Cmd: "ok"})
+	}
+	for _, r := range res {
+		r.ID = p.ID
+		if err := c.send(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Device) dispatch(c *conn, p proto.Packet) ([]proto.Packet, error) {
+	d.mu.Lock()
+	h, ok := d.handlers[p.Cmd]
+	d.mu.Unlock()
+	if ok {
+		return h(p.Args)
+	}
+
+	switch p.Cmd {
+	case "info":
+		info := proto.Packet{Cmd: "info", Args: map[string]string{
+			"id":    d.ID,
+			"model": d.Model,
+			"hw":    d.HardwareVer,
+			"fw":    d.FirmwareVer,
+		}}
+		if d.Pipelining {
+			info.Args["caps"] = "rid"
+		}
+		return []proto.Packet{info}, nil
+	case "list":
+		d.mu.Lock()
+		res := make([]proto.Packet, 0, len(d.order))
+		for _, name := range d.order {
+			args := map[string]string{"name": name, "value": d.attrs[name]}
+			for k, v := range d.meta[name] {
+				args[k] = v
+			}
+			res = append(res, proto.Packet{Cmd: "attr", Args: args})
+		}
+		d.mu.Unlock()
+		return res, nil
+	case "set":
+		name, ok := p.Args["name"]
+		if !ok {
+			return nil, errors.New("missing name")
+		}
+		if _, ok := d.Attr(name); !ok {
+			return nil, fmt.Errorf("unknown attribute %s", name)
+		}
+		if p.Args["disconnect"] == "true" {
+			c.mu.Lock()
+			c.onDisconnect[name] = p.Args["value"]
+			c.mu.Unlock()
+			return nil, nil
+		}
+		d.SetAttr(name, p.Args["value"])
+		return nil, nil
+	case "sub":
+		c.mu.Lock()
+		c.filters = append(c.filters, p.Args["filter"])
+		c.mu.Unlock()
+		return nil, nil
+	case "ping":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unknown command %s", p.Cmd)
+}
+
+// connList snapshots the connected clients, d.mu must be held
+func (d *Device) connList() []*conn {
+	conns := make([]*conn, 0, len(d.conns))
+	for c := range d.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+type conn struct {
+	rwc          io.ReadWriteCloser
+	encoder      *proto.Encoder
+	mu           sync.Mutex
+	filters      []string
+	onDisconnect map[string]string
+}
+
+func (c *conn) subscribed(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, f := range c.filters {
+		if f == "*" || f == ">" || iotfwdrv.KeyMatch(name, f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *conn) send(p proto.Packet) error {
+	return c.encoder.Encode(p)
+}
@@ -0,0 +1,226 @@
+package iotfwtest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pborges/iotfwdrv/proto"
+)
+
+// client speaks the raw protocol to a Device
+type client struct {
+	t       *testing.T
+	encoder *proto.Encoder
+	packets chan proto.Packet
+}
+
+func dial(t *testing.T, d *Device) *client {
+	t.Helper()
+	rwc, err := d.Dialer()()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rwc.Close()
+	})
+	c := &client{t: t, encoder: proto.NewEncoder(rwc), packets: make(chan proto.Packet, 100)}
+	go func() {
+		defer close(c.packets)
+		decoder := proto.NewDecoder(rwc)
+		for {
+			p, err := decoder.Decode()
+			if err != nil {
+				return
+			}
+			c.packets <- p
+		}
+	}()
+	return c
+}
+
+// next returns the next packet the device sent
+func (c *client) next() proto.Packet {
+	c.t.Helper()
+	select {
+	case p, ok := <-c.packets:
+		if !ok {
+			c.t.Fatal("connection closed")
+		}
+		return p
+	case <-time.After(time.Second):
+		c.t.Fatal("timeout waiting for the device")
+	}
+	return proto.Packet{}
+}
+
+// do sends cmd and returns every packet up to and including the terminator
+func (c *client) do(cmd string, args map[string]string) []proto.Packet {
+	c.t.Helper()
+	if args == nil {
+		args = map[string]string{}
+	}
+	if err := c.encoder.Encode(proto.Packet{Cmd: cmd, Args: args}); err != nil {
+		c.t.Fatal(err)
+	}
+	var res []proto.Packet
+	for {
+		p := c.next()
+		res = append(res, p)
+		if p.Cmd == "ok" || p.Cmd == "err" {
+			return res
+		}
+	}
+}
+
+func cmds(packets []proto.Packet) []string {
+	var cmds []string
+	for _, p := range packets {
+		cmds = append(cmds, p.Cmd)
+	}
+	return cmds
+}
+
+func TestInfoAndList(t *testing.T) {
+	d := NewDevice("dev1", "Device One")
+	d.SetAttr("relay.0", "false")
+	d.Describe("relay.0", map[string]string{"type": "bool"})
+	c := dial(t, d)
+
+	res := c.do("info", nil)
+	want := []proto.Packet{
+		{Cmd: "info", Args: map[string]string{"id": "dev1", "model": "iotfwtest", "hw": "1.0", "fw": "1.0"}},
+		{Cmd: "ok", Args: map[string]string{}},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("info = %v, want %v", res, want)
+	}
+
+	res = c.do("list", nil)
+	want = []proto.Packet{
+		{Cmd: "attr", Args: map[string]string{"name": "config.name", "value": "Device One"}},
+		{Cmd: "attr", Args: map[string]string{"name": "relay.0", "value": "false", "type": "bool"}},
+		{Cmd: "ok", Args: map[string]string{}},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Fatalf("list = %v, want %v", res, want)
+	}
+}
+
+func TestSetAndSubscribe(t *testing.T) {
+	d := NewDevice("dev1", "Device One")
+	d.SetAttr("relay.0", "false")
+	d.SetAttr("led", "off")
+	c := dial(t, d)
+
+	// nothing is pushed before sub
+	if res := c.do("set", map[string]string{"name": "relay.0", "value": "true"}); !reflect.DeepEqual(cmds(res), []string{"ok"}) {
+		t.Fatalf("set = %v, want ok", res)
+	}
+	c.do("sub", map[string]string{"filter": "relay.*"})
+
+	res := c.do("set", map[string]string{"name": "relay.0", "value": "false"})
+	if !reflect.DeepEqual(cmds(res), []string{"@attr", "ok"}) || res[0].Args["value"] != "false" {
+		t.Fatalf("set = %v, want the @attr push then ok", res)
+	}
+	if v, _ := d.Attr("relay.0"); v != "false" {
+		t.Fatalf("relay.0 = %q, want false", v)
+	}
+
+	// led is not covered by the filter, relay.1 is
+	d.SetAttr("led", "on")
+	d.SetAttr("relay.1", "true")
+	if p := c.next(); p.Cmd != "@attr" || p.Args["name"] != "relay.1" {
+		t.Fatalf("pushed %v, want relay.1", p)
+	}
+
+	if res := c.do("set", map[string]string{"name": "missing", "value": "1"}); res[0].Cmd != "err" {
+		t.Fatalf("set of an unknown attribute = %v, want err", res)
+	}
+	if res := c.do("bogus", nil); res[0].Cmd != "err" {
+		t.Fatalf("unknown command = %v, want err", res)
+	}
+}
+
+func TestSetOnDisconnect(t *testing.T) {
+	d := NewDevice("dev1", "Device One")
+	d.SetAttr("relay.0", "true")
+	c := dial(t, d)
+
+	c.do("set", map[string]string{"name": "relay.0", "value": "false", "disconnect": "true"})
+	if v, _ := d.Attr("relay.0"); v != "true" {
+		t.Fatalf("relay.0 = %q before disconnecting, want true", v)
+	}
+	d.Drop()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if v, _ := d.Attr("relay.0"); v == "false" && d.Conns() == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("disconnect value never applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	d := NewDevice("dev1", "Device One")
+	d.Handle("reboot", func(args map[string]string) ([]proto.Packet, error) {
+		return []proto.Packet{Output("rebooting in " + args["delay"])}, nil
+	})
+	d.Handle("ping", func(args map[string]string) ([]proto.Packet, error) {
+		return nil, errors.New("busy")
+	})
+	c := dial(t, d)
+
+	res := c.do("reboot", map[string]string{"delay": "5"})
+	if !reflect.DeepEqual(cmds(res), []string{"output", "ok"}) || res[0].Args["msg"] != "rebooting in 5" {
+		t.Fatalf("reboot = %v", res)
+	}
+	if res := c.do("ping", nil); res[0].Cmd != "err" || res[0].Args["msg"] != "busy" {
+		t.Fatalf("ping = %v, want err msg:busy", res)
+	}
+
+	// removing the handler restores the built in behaviour
+	d.Handle("ping", nil)
+	if res := c.do("ping", nil); !reflect.DeepEqual(cmds(res), []string{"ok"}) {
+		t.Fatalf("ping = %v, want ok", res)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	d := NewDevice("dev1", "Device One")
+	d.Pipelining = true
+	release := make(chan struct{})
+	d.Handle("slow", func(args map[string]string) ([]proto.Packet, error) {
+		<-release
+		return []proto.Packet{Output("slow")}, nil
+	})
+	c := dial(t, d)
+
+	if res := c.do("info", nil); res[0].Args["caps"] != "rid" {
+		t.Fatalf("info = %v, want caps:rid", res)
+	}
+
+	// a tagged command does not hold up the ones behind it
+	for _, p := range []proto.Packet{
+		{ID: 1, Cmd: "slow", Args: map[string]string{}},
+		{ID: 2, Cmd: "ping", Args: map[string]string{}},
+	} {
+		if err := c.encoder.Encode(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if p := c.next(); p.ID != 2 || p.Cmd != "ok" {
+		t.Fatalf("got %v, want ok rid:2 first", p)
+	}
+	close(release)
+	if p := c.next(); p.ID != 1 || p.Cmd != "output" {
+		t.Fatalf("got %v, want output rid:1", p)
+	}
+	if p := c.next(); p.ID != 1 || p.Cmd != "ok" {
+		t.Fatalf("got %v, want ok rid:1", p)
+	}
+}
@@ -0,0 +1,17 @@
+package iotfwtest
+
+import "github.com/pborges/iotfwdrv/proto"
+
+// Output builds an output line, returned to the driver in Response.Output
+func Output(msg string) proto.Packet {
+	return proto.Packet{Cmd: "output", Args: map[string]string{"msg": msg}}
+}
+
+// Debug builds a debug line, returned to the driver in Response.Debug
+func Debug(msg string) proto.Packet {
+	return proto.Packet{Cmd: "debug", Args: map[string]string{"msg": msg}}
+}
+
+func errPacket(err error) proto.Packet {
+	return proto.Packet{Cmd: "err", Args: map[string]string{"msg": err.Error()}}
+}
@@ -5,8 +5,36 @@ import "strings"
 const KeyEvent = "@event"
 const KeyEventConnect = "connect"
 const KeyEventDisconnect = "disconnect"
+const KeySnapshot = "@snapshot"
+const KeySnapshotEnd = "end"
 
+// KeyMatch reports whether attr matches filter, a comma separated list of
+// dotted patterns where * matches one segment and > matches the rest. Patterns
+// prefixed with ! exclude matching keys, a filter made only of exclusions
+// matches everything else.
 func KeyMatch(attr string, filter string) bool {
+	var matched, include, exclude bool
+	for _, f := range strings.Split(filter, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if strings.HasPrefix(f, "!") {
+			exclude = true
+			if keyMatch(attr, f[1:]) {
+				return false
+			}
+			continue
+		}
+		include = true
+		if !matched {
+			matched = keyMatch(attr, f)
+		}
+	}
+	return matched || (exclude && !include)
+}
+
+func keyMatch(attr string, filter string) bool {
 	segAttr := strings.Split(attr, ".")
 	segFilter := strings.Split(filter, ".")
 
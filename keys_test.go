@@ -0,0 +1,49 @@
+package iotfwdrv_test
+
+import (
+	"testing"
+
+	"github.com/pborges/iotfwdrv"
+)
+
+func TestKeyMatch(t *testing.T) {
+	tests := []struct {
+		attr   string
+		filter string
+		want   bool
+	}{
+		{"relay.0", "relay.0", true},
+		{"relay.0", "relay.1", false},
+		{"relay.0", "relay.*", true},
+		{"relay.0.state", "relay.*", false},
+		{"relay.0.state", "relay.>", true},
+		{"relay", "relay.>", true},
+		{"relay.0", "*", false},
+		{"relay.0", ">", true},
+
+		// comma separated patterns match if any does
+		{"led", "relay.*,led", true},
+		{"relay.1", "relay.*, led", true},
+		{"button", "relay.*,led", false},
+		{"led", " , led ,", true},
+		{"led", "", false},
+
+		// exclusions win over any inclusion
+		{"relay.0", "relay.*,!relay.0", false},
+		{"relay.1", "relay.*,!relay.0", true},
+		{"relay.1", "!relay.0,relay.*", true},
+		{"led", "relay.*,!relay.0", false},
+		{"config.name", ">,!config.>", false},
+
+		// a filter of only exclusions matches everything else
+		{"relay.0", "!config.>", true},
+		{"config.name", "!config.>", false},
+		{"config.name", "!relay.*,!led", true},
+		{"led", "!relay.*,!led", false},
+	}
+	for _, tt := range tests {
+		if got := iotfwdrv.KeyMatch(tt.attr, tt.filter); got != tt.want {
+			t.Errorf("KeyMatch(%q, %q) = %v, want %v", tt.attr, tt.filter, got, tt.want)
+		}
+	}
+}
@@ -2,51 +2,602 @@ package iotfwdrv
 
 import (
 	"context"
-	"github.com/grandcat/zeroconf"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
-func textLookup(key string, text []string) string {
-	p := key + "="
-	for _, t := range text {
-		if strings.HasPrefix(t, p) {
-			return strings.TrimPrefix(t, p)
-		}
+// DefaultQueryInterval is the longest a Discoverer waits between queries, it
+// starts at one second and doubles up to this
+const DefaultQueryInterval = time.Minute
+
+var (
+	mdnsGroupIPv4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsGroupIPv6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+var ErrDiscovererStarted = errors.New("discoverer already started")
+
+// MalformedEntryError is reported for an announced device whose TXT record
+// cannot be turned into Metadata
+type MalformedEntryError struct {
+	Entry DiscoveryEntry
+	Err   error
+}
+
+func (e *MalformedEntryError) Error() string {
+	return fmt.Sprintf("malformed mdns entry %s: %v", e.Entry.Instance, e.Err)
+}
+
+func (e *MalformedEntryError) Unwrap() error {
+	return e.Err
+}
+
+// DiscoveryEntry is a device announced over mDNS, Instance is the device ID
+type DiscoveryEntry struct {
+	Instance string
+	Host     string
+	Port     int
+	IPv4     []net.IP
+	IPv6     []net.IP
+	Text     map[string]string
+}
+
+// MetadataAndAddr converts e for Service.Register, preferring an IPv4 address
+func (e DiscoveryEntry) MetadataAndAddr() (m MetadataAndAddr, err error) {
+	m.ID = e.Instance
+	m.Name = e.Text["name"]
+	m.Model = e.Text["model"]
+	if m.HardwareVer, err = ParseVersion(e.Text["hw"]); err != nil {
+		err = fmt.Errorf("hw version %q: %w", e.Text["hw"], err)
+		return
+	}
+	if m.FirmwareVer, err = ParseVersion(e.Text["fw"]); err != nil {
+		err = fmt.Errorf("fw version %q: %w", e.Text["fw"], err)
+		return
+	}
+	switch {
+	case len(e.IPv4) > 0:
+		m.Addr.IP = e.IPv4[0]
+	case len(e.IPv6) > 0:
+		m.Addr.IP = e.IPv6[0]
+	default:
+		err = errors.New("no address")
+		return
+	}
+	m.Addr.Port = e.Port
+	return
+}
+
+// Discoverer browses for devices over mDNS. It keeps every record until its
+// TTL expires or the device says goodbye and reports the devices as they come
+// and go. The callbacks are called from a single goroutine.
+type Discoverer struct {
+	// Service defaults to MdnsService
+	Service string
+	// Interface to browse on, every interface that is up and multicast
+	// capable when nil
+	Interface     *net.Interface
+	QueryInterval time.Duration
+	Log           *slog.Logger
+	// OnFound is called for a new device and again whenever its entry changes
+	OnFound func(e DiscoveryEntry, m MetadataAndAddr)
+	// OnGone is called when every record of a found device expired or was
+	// withdrawn with a goodbye
+	OnGone func(e DiscoveryEntry)
+	// OnError is called with a *MalformedEntryError for devices that cannot
+	// be reported and with errors reading or querying the network
+	OnError func(err error)
+
+	lock    sync.Mutex
+	conns   []*mdnsConn
+	cancel  context.CancelFunc
+	done    chan struct{}
+	records map[string]*mdnsInstance
+	hosts   map[string]map[string]mdnsAddr
+}
+
+type mdnsInstance struct {
+	ptrExpires time.Time
+	srvExpires time.Time
+	txtExpires time.Time
+	host       string
+	port       int
+	text       map[string]string
+	reported   *DiscoveryEntry
+	found      bool
+}
+
+// mdnsConn is the socket of one address family, joined to the group on ifaces.
+// Queries go out on each of ifaces, or wherever the system routes the group
+// when ifaces is empty.
+type mdnsConn struct {
+	conn   *net.UDPConn
+	group  *net.UDPAddr
+	ifaces []net.Interface
+}
+
+type mdnsAddr struct {
+	ip      net.IP
+	expires time.Time
+}
+
+func (d *Discoverer) log() *slog.Logger {
+	if d.Log != nil {
+		return d.Log
 	}
-	return ""
+	return discardLogger
 }
 
-func HandleMDNS(ctx context.Context, onDiscover func(m MetadataAndAddr)) {
-	resolver, err := zeroconf.NewResolver(nil)
+func (d *Discoverer) service() string {
+	if d.Service != "" {
+		return dns.Fqdn(d.Service)
+	}
+	return MdnsService
+}
+
+func (d *Discoverer) queryInterval() time.Duration {
+	if d.QueryInterval > 0 {
+		return d.QueryInterval
+	}
+	return DefaultQueryInterval
+}
+
+// Start joins the mDNS group and begins browsing, it fails if neither the
+// IPv4 nor the IPv6 group can be joined
+func (d *Discoverer) Start() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.done != nil {
+		return ErrDiscovererStarted
+	}
+
+	ifaces, err := d.interfaces()
 	if err != nil {
-		log.Fatalln("Failed to initialize resolver:", err.Error())
+		return fmt.Errorf("unable to list interfaces: %w", err)
+	}
+	var errs []error
+	for _, group := range []*net.UDPAddr{mdnsGroupIPv4, mdnsGroupIPv6} {
+		c, err := listenMDNS(group, ifaces)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		d.conns = append(d.conns, c)
 	}
+	if len(d.conns) == 0 {
+		return fmt.Errorf("unable to join mdns group: %w", errors.Join(errs...))
+	}
+	for _, err := range errs {
+		d.log().Debug("mdns group unavailable", "err", err)
+	}
+
+	d.records = make(map[string]*mdnsInstance)
+	d.hosts = make(map[string]map[string]mdnsAddr)
+	ctx, cancel := context.WithCancel(context.Background())
+	d.cancel = cancel
+	d.done = make(chan struct{})
+	go d.run(ctx)
+	return nil
+}
+
+// Close stops browsing and waits for the last callback to return
+func (d *Discoverer) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.done == nil {
+		return nil
+	}
+	d.cancel()
+	var err error
+	for _, c := range d.conns {
+		if cerr := c.conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	<-d.done
+	d.conns = nil
+	d.done = nil
+	return err
+}
+
+func (d *Discoverer) run(ctx context.Context) {
+	defer close(d.done)
 
-	entries := make(chan *zeroconf.ServiceEntry)
-	go func() {
-		for e := range entries {
-			m := MetadataAndAddr{
-				Metadata: Metadata{
-					ID:    e.ServiceRecord.Instance,
-					Name:  textLookup("name", e.Text),
-					Model: textLookup("model", e.Text),
-				},
+	msgs := make(chan *dns.Msg, 32)
+	errs := make(chan error, len(d.conns))
+	readers := new(sync.WaitGroup)
+	for _, c := range d.conns {
+		readers.Add(1)
+		go func(conn *net.UDPConn) {
+			defer readers.Done()
+			if err := d.read(ctx, conn, msgs); err != nil {
+				errs <- err
 			}
-			m.HardwareVer, _ = ParseVersion(textLookup("hw", e.Text))
-			m.FirmwareVer, _ = ParseVersion(textLookup("fw", e.Text))
-			if len(e.AddrIPv4) > 0 {
-				m.Addr.IP = e.AddrIPv4[0]
+		}(c.conn)
+	}
+	defer readers.Wait()
+
+	interval := time.Second
+	query := time.NewTimer(0)
+	defer query.Stop()
+	sweep := time.NewTicker(time.Second)
+	defer sweep.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-query.C:
+			d.query()
+			query.Reset(interval)
+			if interval *= 2; interval > d.queryInterval() {
+				interval = d.queryInterval()
 			}
-			m.Addr.Port = e.Port
-			onDiscover(m)
+		case msg := <-msgs:
+			d.handle(msg, time.Now())
+			d.report(time.Now())
+		case err := <-errs:
+			d.error(err)
+		case now := <-sweep.C:
+			d.report(now)
+		}
+	}
+}
+
+// read decodes responses from conn until it fails, the error is nil when the
+// failure was caused by Close
+func (d *Discoverer) read(ctx context.Context, conn *net.UDPConn, msgs chan<- *dns.Msg) error {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("mdns read: %w", err)
 		}
-	}()
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil {
+			d.log().Debug("discarding undecodable mdns packet", "err", err)
+			continue
+		}
+		if !msg.Response {
+			continue
+		}
+		select {
+		case msgs <- msg:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
 
-	err = resolver.Browse(ctx, "_iotfw._tcp", "local.", entries)
+func (d *Discoverer) query() {
+	msg := new(dns.Msg)
+	msg.SetQuestion(d.service(), dns.TypePTR)
+	msg.RecursionDesired = false
+	buf, err := msg.Pack()
 	if err != nil {
-		log.Fatalln("Failed to browse:", err.Error())
+		d.error(fmt.Errorf("mdns query: %w", err))
+		return
 	}
+	for _, c := range d.conns {
+		if len(c.ifaces) == 0 {
+			if _, err := c.conn.WriteToUDP(buf, c.group); err != nil {
+				d.log().Debug("unable to send mdns query", "group", c.group.String(), "err", err)
+			}
+			continue
+		}
+		for i := range c.ifaces {
+			ifi := &c.ifaces[i]
+			err := setMulticastInterface(c.conn, c.group, ifi)
+			if err == nil {
+				_, err = c.conn.WriteToUDP(buf, c.group)
+			}
+			if err != nil {
+				d.log().Debug("unable to send mdns query", "group", c.group.String(), "interface", ifi.Name, "err", err)
+			}
+		}
+	}
+}
+
+// interfaces returns the interfaces to browse on, none means leaving the
+// choice to the system
+func (d *Discoverer) interfaces() ([]net.Interface, error) {
+	if d.Interface != nil {
+		return []net.Interface{*d.Interface}, nil
+	}
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var ifaces []net.Interface
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 {
+			ifaces = append(ifaces, ifi)
+		}
+	}
+	return ifaces, nil
+}
 
+// listenMDNS opens one socket for the family of group and joins the group on
+// every interface it can, interfaces lacking an address of that family are
+// skipped
+func listenMDNS(group *net.UDPAddr, ifaces []net.Interface) (*mdnsConn, error) {
+	network := "udp4"
+	if group.IP.To4() == nil {
+		network = "udp6"
+	}
+	if len(ifaces) == 0 {
+		conn, err := net.ListenMulticastUDP(network, nil, group)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", network, err)
+		}
+		return &mdnsConn{conn: conn, group: group}, nil
+	}
+
+	c := &mdnsConn{group: group}
+	var errs []error
+	for i := range ifaces {
+		ifi := &ifaces[i]
+		var err error
+		if c.conn == nil {
+			c.conn, err = net.ListenMulticastUDP(network, ifi, group)
+		} else {
+			err = joinGroup(c.conn, group, ifi)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s on %s: %w", network, ifi.Name, err))
+			continue
+		}
+		c.ifaces = append(c.ifaces, *ifi)
+	}
+	if c.conn == nil {
+		return nil, errors.Join(errs...)
+	}
+	return c, nil
+}
+
+func joinGroup(conn *net.UDPConn, group *net.UDPAddr, ifi *net.Interface) error {
+	if group.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn).JoinGroup(ifi, group)
+	}
+	return ipv6.NewPacketConn(conn).JoinGroup(ifi, group)
+}
+
+func setMulticastInterface(conn *net.UDPConn, group *net.UDPAddr, ifi *net.Interface) error {
+	if group.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn).SetMulticastInterface(ifi)
+	}
+	return ipv6.NewPacketConn(conn).SetMulticastInterface(ifi)
+}
+
+// handle caches the records of msg, a TTL of zero is a goodbye and expires
+// the record immediately
+func (d *Discoverer) handle(msg *dns.Msg, now time.Time) {
+	service := d.service()
+	var records []dns.RR
+	records = append(records, msg.Answer...)
+	records = append(records, msg.Ns...)
+	records = append(records, msg.Extra...)
+	for _, rr := range records {
+		expires := now.Add(time.Duration(rr.Header().Ttl) * time.Second)
+		switch rr := rr.(type) {
+		case *dns.PTR:
+			if !strings.EqualFold(rr.Hdr.Name, service) {
+				continue
+			}
+			d.instance(rr.Ptr).ptrExpires = expires
+		case *dns.SRV:
+			if !isInstanceOf(rr.Hdr.Name, service) {
+				continue
+			}
+			inst := d.instance(rr.Hdr.Name)
+			inst.srvExpires = expires
+			inst.host = strings.ToLower(rr.Target)
+			inst.port = int(rr.Port)
+		case *dns.TXT:
+			if !isInstanceOf(rr.Hdr.Name, service) {
+				continue
+			}
+			inst := d.instance(rr.Hdr.Name)
+			inst.txtExpires = expires
+			inst.text = parseText(rr.Txt)
+		case *dns.A:
+			d.addAddr(rr.Hdr.Name, rr.A, expires)
+		case *dns.AAAA:
+			d.addAddr(rr.Hdr.Name, rr.AAAA, expires)
+		}
+	}
+}
+
+func (d *Discoverer) instance(name string) *mdnsInstance {
+	name = strings.ToLower(name)
+	inst, ok := d.records[name]
+	if !ok {
+		inst = &mdnsInstance{}
+		d.records[name] = inst
+	}
+	return inst
+}
+
+func (d *Discoverer) addAddr(host string, ip net.IP, expires time.Time) {
+	host = strings.ToLower(host)
+	addrs, ok := d.hosts[host]
+	if !ok {
+		addrs = make(map[string]mdnsAddr)
+		d.hosts[host] = addrs
+	}
+	addrs[ip.String()] = mdnsAddr{ip: ip, expires: expires}
+}
+
+// report expires stale records and calls OnFound and OnGone for every
+// instance whose entry changed
+func (d *Discoverer) report(now time.Time) {
+	for host, addrs := range d.hosts {
+		for key, a := range addrs {
+			if !now.Before(a.expires) {
+				delete(addrs, key)
+			}
+		}
+		if len(addrs) == 0 {
+			delete(d.hosts, host)
+		}
+	}
+
+	names := make([]string, 0, len(d.records))
+	for name := range d.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		inst := d.records[name]
+		entry, ok := d.entry(name, inst, now)
+		if !ok {
+			if inst.found {
+				d.log().Debug("mdns device gone", "instance", inst.reported.Instance)
+				if d.OnGone != nil {
+					d.OnGone(*inst.reported)
+				}
+			}
+			if !now.Before(inst.ptrExpires) && !now.Before(inst.srvExpires) && !now.Before(inst.txtExpires) {
+				delete(d.records, name)
+			} else {
+				inst.reported = nil
+				inst.found = false
+			}
+			continue
+		}
+		if inst.reported != nil && reflect.DeepEqual(*inst.reported, entry) {
+			continue
+		}
+		inst.reported = &entry
+
+		m, err := entry.MetadataAndAddr()
+		if err != nil {
+			d.error(&MalformedEntryError{Entry: entry, Err: err})
+			continue
+		}
+		inst.found = true
+		d.log().Debug("mdns device found", "instance", entry.Instance, "addr", m.Addr.String())
+		if d.OnFound != nil {
+			d.OnFound(entry, m)
+		}
+	}
+}
+
+// entry assembles the live records of inst, a device needs an unexpired PTR
+// and SRV and at least one address
+func (d *Discoverer) entry(name string, inst *mdnsInstance, now time.Time) (e DiscoveryEntry, ok bool) {
+	if !now.Before(inst.ptrExpires) || !now.Before(inst.srvExpires) {
+		return
+	}
+	e = DiscoveryEntry{
+		Instance: instanceName(name, d.service()),
+		Host:     inst.host,
+		Port:     inst.port,
+		Text:     map[string]string{},
+	}
+	if now.Before(inst.txtExpires) {
+		e.Text = inst.text
+	}
+	addrs := d.hosts[inst.host]
+	keys := make([]string, 0, len(addrs))
+	for key := range addrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		ip := addrs[key].ip
+		if ip.To4() != nil {
+			e.IPv4 = append(e.IPv4, ip)
+		} else {
+			e.IPv6 = append(e.IPv6, ip)
+		}
+	}
+	return e, len(e.IPv4)+len(e.IPv6) > 0
+}
+
+func (d *Discoverer) error(err error) {
+	d.log().Warn("mdns discovery", "err", err)
+	if d.OnError != nil {
+		d.OnError(err)
+	}
+}
+
+func isInstanceOf(name string, service string) bool {
+	name, service = strings.ToLower(name), strings.ToLower(service)
+	return strings.HasSuffix(name, "."+service)
+}
+
+// instanceName strips the service from a fully qualified instance name and
+// undoes the DNS escaping of the instance label
+func instanceName(name string, service string) string {
+	label := name[:len(name)-len(service)-1]
+	var b strings.Builder
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 == len(label) {
+			b.WriteByte(label[i])
+			continue
+		}
+		i++
+		if i+2 < len(label) && isDigits(label[i:i+3]) {
+			n, _ := strconv.Atoi(label[i : i+3])
+			b.WriteByte(byte(n))
+			i += 2
+			continue
+		}
+		b.WriteByte(label[i])
+	}
+	return b.String()
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseText turns key=value TXT strings into a map, a bare key maps to ""
+func parseText(txt []string) map[string]string {
+	text := make(map[string]string, len(txt))
+	for _, t := range txt {
+		key, value, _ := strings.Cut(t, "=")
+		if _, ok := text[key]; !ok {
+			text[key] = value
+		}
+	}
+	return text
+}
+
+// HandleMDNS browses for devices until ctx is done, calling onDiscover for
+// every device found or changed. It returns an error only if browsing could
+// not start, use a Discoverer to also learn of devices going away.
+func HandleMDNS(ctx context.Context, onDiscover func(m MetadataAndAddr)) error {
+	d := &Discoverer{
+		OnFound: func(e DiscoveryEntry, m MetadataAndAddr) {
+			onDiscover(m)
+		},
+	}
+	if err := d.Start(); err != nil {
+		return err
+	}
 	<-ctx.Done()
+	return d.Close()
 }
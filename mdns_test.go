@@ -0,0 +1,158 @@
+package iotfwdrv
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// discovererRecorder collects what a Discoverer reports
+type discovererRecorder struct {
+	found []DiscoveryEntry
+	gone  []DiscoveryEntry
+	errs  []error
+}
+
+func newTestDiscoverer() (*Discoverer, *discovererRecorder) {
+	rec := &discovererRecorder{}
+	d := &Discoverer{
+		OnFound: func(e DiscoveryEntry, m MetadataAndAddr) { rec.found = append(rec.found, e) },
+		OnGone:  func(e DiscoveryEntry) { rec.gone = append(rec.gone, e) },
+		OnError: func(err error) { rec.errs = append(rec.errs, err) },
+		records: make(map[string]*mdnsInstance),
+		hosts:   make(map[string]map[string]mdnsAddr),
+	}
+	return d, rec
+}
+
+// announcement is the response a device sends, ttl applies to every record
+func announcement(instance string, host string, ip string, ttl uint32, txt ...string) *dns.Msg {
+	name := instance + "." + MdnsService
+	hdr := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		&dns.PTR{Hdr: hdr(MdnsService, dns.TypePTR), Ptr: name},
+	}
+	msg.Extra = []dns.RR{
+		&dns.SRV{Hdr: hdr(name, dns.TypeSRV), Target: host, Port: 5000},
+		&dns.TXT{Hdr: hdr(name, dns.TypeTXT), Txt: txt},
+		&dns.A{Hdr: hdr(host, dns.TypeA), A: net.ParseIP(ip)},
+	}
+	return msg
+}
+
+var relayText = []string{"name=Garage", "model=relay", "hw=1.0.0", "fw=2.1.3"}
+
+func TestDiscovererTTLExpiry(t *testing.T) {
+	d, rec := newTestDiscoverer()
+	now := time.Now()
+	d.handle(announcement("a4cf12f00d", "relay.local.", "10.0.0.5", 120, relayText...), now)
+	d.report(now)
+	if len(rec.found) != 1 {
+		t.Fatalf("found %d devices, want 1", len(rec.found))
+	}
+	e := rec.found[0]
+	if e.Instance != "a4cf12f00d" || e.Port != 5000 || e.Text["name"] != "Garage" || !e.IPv4[0].Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+
+	// unchanged records are not reported again
+	d.handle(announcement("a4cf12f00d", "relay.local.", "10.0.0.5", 120, relayText...), now.Add(time.Second))
+	d.report(now.Add(time.Second))
+	if len(rec.found) != 1 {
+		t.Fatalf("found %d times, want 1", len(rec.found))
+	}
+
+	// the repeat refreshed the TTL
+	d.report(now.Add(120 * time.Second))
+	if len(rec.gone) != 0 {
+		t.Fatalf("gone = %+v before the refreshed TTL", rec.gone)
+	}
+
+	d.report(now.Add(121 * time.Second))
+	if len(rec.gone) != 1 || rec.gone[0].Instance != "a4cf12f00d" {
+		t.Fatalf("gone = %+v, want a4cf12f00d", rec.gone)
+	}
+	if len(d.records) != 0 || len(d.hosts) != 0 {
+		t.Fatalf("expired records kept: %v %v", d.records, d.hosts)
+	}
+}
+
+func TestDiscovererGoodbye(t *testing.T) {
+	d, rec := newTestDiscoverer()
+	now := time.Now()
+	d.handle(announcement("a4cf12f00d", "relay.local.", "10.0.0.5", 120, relayText...), now)
+	d.report(now)
+
+	// a goodbye withdraws the records well before their TTL
+	d.handle(announcement("a4cf12f00d", "relay.local.", "10.0.0.5", 0, relayText...), now.Add(time.Second))
+	d.report(now.Add(time.Second))
+	if len(rec.gone) != 1 {
+		t.Fatalf("gone %d devices, want 1", len(rec.gone))
+	}
+
+	// and the device is found again when it comes back
+	d.handle(announcement("a4cf12f00d", "relay.local.", "10.0.0.6", 120, relayText...), now.Add(2*time.Second))
+	d.report(now.Add(2 * time.Second))
+	if len(rec.found) != 2 || !rec.found[1].IPv4[0].Equal(net.ParseIP("10.0.0.6")) {
+		t.Fatalf("found = %+v, want a second entry at 10.0.0.6", rec.found)
+	}
+}
+
+func TestDiscovererMalformedEntry(t *testing.T) {
+	d, rec := newTestDiscoverer()
+	now := time.Now()
+	d.handle(announcement("broken", "broken.local.", "10.0.0.7", 120, "model=relay", "hw=bogus", "fw=1.0.0"), now)
+	d.report(now)
+	if len(rec.found) != 0 {
+		t.Fatalf("malformed entry reported as found: %+v", rec.found)
+	}
+	var malformed *MalformedEntryError
+	if len(rec.errs) != 1 || !errors.As(rec.errs[0], &malformed) || malformed.Entry.Instance != "broken" {
+		t.Fatalf("errs = %v, want a MalformedEntryError for broken", rec.errs)
+	}
+
+	// the same broken entry is not reported on every sweep
+	d.report(now.Add(time.Second))
+	if len(rec.errs) != 1 {
+		t.Fatalf("reported %d errors, want 1", len(rec.errs))
+	}
+}
+
+func TestInstanceName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a4cf12f00d." + MdnsService, "a4cf12f00d"},
+		{`Garage\ Door.` + MdnsService, "Garage Door"},
+		{`dotted\.name.` + MdnsService, "dotted.name"},
+		{`back\\slash.` + MdnsService, `back\slash`},
+		{`caf\195\169.` + MdnsService, "café"},
+		{`short\19.` + MdnsService, "short19"},
+	}
+	for _, tt := range tests {
+		if got := instanceName(tt.name, MdnsService); got != tt.want {
+			t.Errorf("instanceName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseText(t *testing.T) {
+	got := parseText([]string{"name=a=b", "flag", "name=ignored", "empty="})
+	want := map[string]string{"name": "a=b", "flag": "", "empty": ""}
+	if len(got) != len(want) {
+		t.Fatalf("parseText = %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("parseText = %v, want %v", got, want)
+		}
+	}
+}
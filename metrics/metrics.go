@@ -0,0 +1,227 @@
+// Package metrics exports a Service and its devices to Prometheus.
+//
+//	exp := metrics.New(svc)
+//	svc.Observer = exp
+//	svc.Plugins = append(svc.Plugins, exp)
+//	http.Handle("/metrics", exp.Handler())
+//
+// The Observer must be set before devices are registered for their command
+// latency to be recorded.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pborges/iotfwdrv"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const Namespace = "iotfw"
+
+// Exporter implements iotfwdrv.Observer and collects per device gauges from
+// the Service on every scrape
+type Exporter struct {
+	svc             *iotfwdrv.Service
+	registry        *prometheus.Registry
+	writeDuration   *prometheus.HistogramVec
+	writeErrors     *prometheus.CounterVec
+	timeouts        *prometheus.CounterVec
+	connects        *prometheus.CounterVec
+	reconnects      *prometheus.CounterVec
+	slowSubscribers prometheus.Counter
+	scanDuration    prometheus.Histogram
+	scanFound       prometheus.Gauge
+	connectedLock   sync.Mutex
+	connectedBefore map[string]bool
+}
+
+func New(svc *iotfwdrv.Service) *Exporter {
+	e := &Exporter{
+		svc:             svc,
+		registry:        prometheus.NewRegistry(),
+		connectedBefore: make(map[string]bool),
+		writeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "write_duration_seconds",
+			Help:      "Time from writing a command to the device answering it.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 11),
+		}, []string{"id", "cmd"}),
+		writeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "write_errors_total",
+			Help:      "Commands that failed, including timeouts.",
+		}, []string{"id", "cmd"}),
+		timeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "write_timeouts_total",
+			Help:      "Commands the device did not answer in time, each drops the connection.",
+		}, []string{"id", "cmd"}),
+		connects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "connect_attempts_total",
+			Help:      "Connect attempts made by the Service.",
+		}, []string{"id", "result"}),
+		reconnects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "reconnects_total",
+			Help:      "Successful connects after the first one.",
+		}, []string{"id"}),
+		slowSubscribers: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "slow_subscriber_closes_total",
+			Help:      "Subscriptions closed because they could not keep up.",
+		}),
+		scanDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "scan_duration_seconds",
+			Help:      "Time taken by a network scan.",
+			Buckets:   prometheus.ExponentialBuckets(0.5, 2, 8),
+		}),
+		scanFound: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "scan_devices_found",
+			Help:      "Devices found by the last network scan.",
+		}),
+	}
+	e.registry.MustRegister(
+		e.writeDuration,
+		e.writeErrors,
+		e.timeouts,
+		e.connects,
+		e.reconnects,
+		e.slowSubscribers,
+		e.scanDuration,
+		e.scanFound,
+		&deviceCollector{svc: svc},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return e
+}
+
+func (e *Exporter) ServiceName() string {
+	return "metrics"
+}
+
+// Registry returns the registry the Exporter serves, to add collectors to it
+func (e *Exporter) Registry() *prometheus.Registry {
+	return e.registry
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (e *Exporter) Handler() http.Handler {
+	return promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{})
+}
+
+func (e *Exporter) ObserveWrite(info iotfwdrv.Metadata, cmd string, elapsed time.Duration, err error) {
+	if err == nil {
+		e.writeDuration.WithLabelValues(info.ID, cmd).Observe(elapsed.Seconds())
+		return
+	}
+	e.writeErrors.WithLabelValues(info.ID, cmd).Inc()
+	if errors.Is(err, iotfwdrv.ErrTimeout) {
+		e.timeouts.WithLabelValues(info.ID, cmd).Inc()
+	}
+}
+
+func (e *Exporter) ObserveConnect(info iotfwdrv.Metadata, err error) {
+	if err != nil {
+		e.connects.WithLabelValues(info.ID, "error").Inc()
+		return
+	}
+	e.connects.WithLabelValues(info.ID, "ok").Inc()
+
+	e.connectedLock.Lock()
+	defer e.connectedLock.Unlock()
+	if e.connectedBefore[info.ID] {
+		e.reconnects.WithLabelValues(info.ID).Inc()
+	}
+	e.connectedBefore[info.ID] = true
+}
+
+func (e *Exporter) ObserveSlowSubscriber(filter string) {
+	e.slowSubscribers.Inc()
+}
+
+func (e *Exporter) ObserveScan(elapsed time.Duration, found int, err error) {
+	e.scanDuration.Observe(elapsed.Seconds())
+	e.scanFound.Set(float64(found))
+}
+
+var (
+	connectedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "device", "connected"),
+		"Whether the device is connected.",
+		[]string{"id"}, nil,
+	)
+	uptimeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "device", "uptime_seconds"),
+		"Time since the device last connected, zero while disconnected.",
+		[]string{"id"}, nil,
+	)
+	infoDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "device", "info"),
+		"Device metadata, always 1.",
+		[]string{"id", "name", "model", "hardware_version", "firmware_version"}, nil,
+	)
+	attributeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(Namespace, "device", "attribute"),
+		"Numeric attribute values, booleans are 1 or 0.",
+		[]string{"id", "attribute"}, nil,
+	)
+)
+
+// deviceCollector reads the devices of a Service at scrape time so the
+// gauges never go stale
+type deviceCollector struct {
+	svc *iotfwdrv.Service
+}
+
+func (c *deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- connectedDesc
+	ch <- uptimeDesc
+	ch <- infoDesc
+	ch <- attributeDesc
+}
+
+func (c *deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, ctx := range c.svc.DeviceContexts() {
+		info := ctx.Info()
+		connected, uptime := 0.0, 0.0
+		if ctx.Connected() {
+			connected = 1
+			if !ctx.ConnectedAt.IsZero() {
+				uptime = time.Since(ctx.ConnectedAt).Seconds()
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(connectedDesc, prometheus.GaugeValue, connected, info.ID)
+		ch <- prometheus.MustNewConstMetric(uptimeDesc, prometheus.GaugeValue, uptime, info.ID)
+		ch <- prometheus.MustNewConstMetric(infoDesc, prometheus.GaugeValue, 1,
+			info.ID, info.Name, info.Model, info.HardwareVer.String(), info.FirmwareVer.String())
+
+		for attr, value := range ctx.Values() {
+			if f, ok := numeric(value); ok {
+				ch <- prometheus.MustNewConstMetric(attributeDesc, prometheus.GaugeValue, f, info.ID, attr)
+			}
+		}
+	}
+}
+
+func numeric(value string) (float64, bool) {
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		return f, true
+	}
+	if b, err := strconv.ParseBool(value); err == nil {
+		if b {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
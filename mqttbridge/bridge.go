@@ -0,0 +1,216 @@
+// Package mqttbridge mirrors a Service to an MQTT broker.
+//
+// Every attribute change is published retained to <prefix>/<id>/<attr>, the
+// connection state of each device is published retained to <prefix>/<id>/state
+// as online or offline, and a message on <prefix>/<id>/<attr>/set calls
+// Device.Set with its payload. The bridge itself publishes online to
+// <prefix>/bridge/state and leaves offline as its will.
+package mqttbridge
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pborges/iotfwdrv"
+)
+
+const DefaultPrefix = "iotfw"
+const DefaultTimeout = 5 * time.Second
+
+const (
+	StateOnline  = "online"
+	StateOffline = "offline"
+)
+
+var ErrStarted = errors.New("bridge already started")
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+type Bridge struct {
+	// Prefix is the first topic level, DefaultPrefix when empty
+	Prefix string
+	QoS    byte
+	// Timeout bounds connecting, subscribing and publishing to the broker,
+	// DefaultTimeout when zero
+	Timeout time.Duration
+	Log     *slog.Logger
+	svc     *iotfwdrv.Service
+	opts    *mqtt.ClientOptions
+	client  mqtt.Client
+	sub     *iotfwdrv.Subscription
+	lock    sync.Mutex
+	done    chan struct{}
+}
+
+// New returns a Bridge between svc and the broker configured by opts, the
+// bridge takes over the OnConnect handler and the will of opts
+func New(svc *iotfwdrv.Service, opts *mqtt.ClientOptions) *Bridge {
+	return &Bridge{
+		svc:  svc,
+		opts: opts,
+	}
+}
+
+func (b *Bridge) ServiceName() string {
+	return "mqtt"
+}
+
+func (b *Bridge) prefix() string {
+	if b.Prefix != "" {
+		return strings.TrimSuffix(b.Prefix, "/")
+	}
+	return DefaultPrefix
+}
+
+func (b *Bridge) timeout() time.Duration {
+	if b.Timeout > 0 {
+		return b.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (b *Bridge) log() *slog.Logger {
+	if b.Log != nil {
+		return b.Log
+	}
+	return discardLogger
+}
+
+// Start connects to the broker and begins mirroring, the current value of
+// every attribute is published first
+func (b *Bridge) Start() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.client != nil {
+		return ErrStarted
+	}
+
+	b.opts.SetWill(b.topic("bridge", "state"), StateOffline, b.QoS, true)
+	// subscriptions do not survive a clean session, renew them on every connect
+	b.opts.SetOnConnectHandler(func(client mqtt.Client) {
+		if err := b.onConnect(client); err != nil {
+			b.log().Error("unable to subscribe", "err", err)
+		}
+	})
+	client := mqtt.NewClient(b.opts)
+	if err := b.wait(client.Connect()); err != nil {
+		return fmt.Errorf("unable to connect to broker %w", err)
+	}
+	b.client = client
+
+	b.sub = b.svc.SubscribeWithOptions(">", iotfwdrv.SubscribeOptions{
+		Replay: true,
+		// the broker only needs the latest value of each key
+		SlowPolicy: iotfwdrv.SlowCoalesce,
+	})
+	// a state change after subscribing is queued behind this and wins, every
+	// device is published so none keeps a stale retained state from before
+	for _, ctx := range b.svc.DeviceContexts() {
+		state := StateOffline
+		if ctx.Connected() {
+			state = StateOnline
+		}
+		b.publishState(ctx.Info().ID, state)
+	}
+	b.done = make(chan struct{})
+	go b.mirror(b.sub, b.done)
+	return nil
+}
+
+// Close stops mirroring, publishes the bridge as offline and disconnects
+func (b *Bridge) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.client == nil {
+		return
+	}
+	b.sub.Close()
+	<-b.done
+	b.publish(b.topic("bridge", "state"), StateOffline)
+	b.client.Disconnect(uint(b.timeout() / time.Millisecond))
+	b.client = nil
+}
+
+func (b *Bridge) onConnect(client mqtt.Client) error {
+	if err := b.wait(client.Publish(b.topic("bridge", "state"), b.QoS, true, StateOnline)); err != nil {
+		return err
+	}
+	return b.wait(client.Subscribe(b.topic("+", "+", "set"), b.QoS, b.onSet))
+}
+
+func (b *Bridge) mirror(sub *iotfwdrv.Subscription, done chan struct{}) {
+	defer close(done)
+	for m := range sub.Chan() {
+		if m.Key == iotfwdrv.KeySnapshot {
+			continue
+		}
+		id := m.Device.ID
+		attr := strings.TrimPrefix(m.Key, id+".")
+		if attr == iotfwdrv.KeyEvent {
+			switch m.Value {
+			case iotfwdrv.KeyEventConnect:
+				b.publishState(id, StateOnline)
+			case iotfwdrv.KeyEventDisconnect:
+				b.publishState(id, StateOffline)
+			}
+			continue
+		}
+		b.publish(b.topic(id, attr), m.Value)
+	}
+	if err := sub.Err(); err != nil && !errors.Is(err, iotfwdrv.ErrSubscriptionClosed) {
+		b.log().Error("subscription closed", "err", err)
+	}
+}
+
+func (b *Bridge) publishState(id string, state string) {
+	b.publish(b.topic(id, "state"), state)
+}
+
+func (b *Bridge) publish(topic string, payload string) {
+	if err := b.wait(b.client.Publish(topic, b.QoS, true, payload)); err != nil {
+		b.log().Warn("unable to publish", "topic", topic, "err", err)
+		return
+	}
+	b.log().Debug("published", "topic", topic, "payload", payload)
+}
+
+// onSet handles <prefix>/<id>/<attr>/set
+func (b *Bridge) onSet(_ mqtt.Client, msg mqtt.Message) {
+	rest := strings.TrimPrefix(msg.Topic(), b.prefix()+"/")
+	rest = strings.TrimSuffix(rest, "/set")
+	parts := strings.SplitN(rest, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		b.log().Warn("ignoring set on malformed topic", "topic", msg.Topic())
+		return
+	}
+	id, attr := parts[0], parts[1]
+	value := string(msg.Payload())
+
+	dev := b.svc.Device(id)
+	if dev == nil {
+		b.log().Warn("ignoring set for unknown device", "id", id, "attr", attr)
+		return
+	}
+	if err := dev.Set(attr, value); err != nil {
+		b.log().Warn("unable to set", "id", id, "attr", attr, "value", value, "err", err)
+		return
+	}
+	b.log().Debug("set", "id", id, "attr", attr, "value", value)
+}
+
+func (b *Bridge) topic(levels ...string) string {
+	return b.prefix() + "/" + strings.Join(levels, "/")
+}
+
+func (b *Bridge) wait(token mqtt.Token) error {
+	if !token.WaitTimeout(b.timeout()) {
+		return errors.New("timeout waiting for broker")
+	}
+	return token.Error()
+}
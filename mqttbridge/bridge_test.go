@@ -0,0 +1,151 @@
+package mqttbridge
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/pborges/iotfwdrv"
+	"github.com/pborges/iotfwdrv/iotfwtest"
+)
+
+// startBroker runs an in-process broker and returns its tcp:// URL
+func startBroker(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := mochi.New(nil)
+	if err := broker.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.AddListener(listeners.NewNet("test", ln)); err != nil {
+		t.Fatal(err)
+	}
+	if err := broker.Serve(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		broker.Close()
+	})
+	return "tcp://" + ln.Addr().String()
+}
+
+// retained collects the latest payload of every topic under iotfw/
+type retained struct {
+	lock   sync.Mutex
+	topics map[string]string
+	client mqtt.Client
+}
+
+func watch(t *testing.T, broker string) *retained {
+	t.Helper()
+	r := &retained{topics: make(map[string]string)}
+	r.client = mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID("watcher"))
+	if token := r.client.Connect(); !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatal("unable to connect watcher", token.Error())
+	}
+	token := r.client.Subscribe(DefaultPrefix+"/#", 1, func(_ mqtt.Client, msg mqtt.Message) {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.topics[msg.Topic()] = string(msg.Payload())
+	})
+	if !token.WaitTimeout(time.Second) || token.Error() != nil {
+		t.Fatal("unable to subscribe watcher", token.Error())
+	}
+	t.Cleanup(func() {
+		r.client.Disconnect(100)
+	})
+	return r
+}
+
+func (r *retained) waitFor(t *testing.T, topic string, payload string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		r.lock.Lock()
+		got, ok := r.topics[topic]
+		r.lock.Unlock()
+		if ok && got == payload {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	t.Fatalf("%s: got %q, want %q", topic, r.topics[topic], payload)
+}
+
+func register(t *testing.T, svc *iotfwdrv.Service, fake *iotfwtest.Device) {
+	t.Helper()
+	addr, err := fake.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fake.Close()
+	})
+	svc.Register(iotfwdrv.MetadataAndAddr{Metadata: fake.Metadata(), Addr: *addr})
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if dev := svc.Device(fake.Metadata().ID); dev != nil && dev.Connected() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s never connected", fake.Metadata().ID)
+}
+
+func TestBridge(t *testing.T) {
+	broker := startBroker(t)
+	svc := &iotfwdrv.Service{ReconnectPolicy: iotfwdrv.ConstantBackoff{Delay: time.Hour}}
+
+	relay := iotfwtest.NewDevice("relay1", "relay")
+	relay.SetAttr("relay.0", "false")
+	register(t, svc, relay)
+	gone := iotfwtest.NewDevice("gone1", "gone")
+	register(t, svc, gone)
+
+	// a previous run left gone1 online, the bridge must not keep it
+	r := watch(t, broker)
+	if token := r.client.Publish(DefaultPrefix+"/gone1/state", 1, true, StateOnline); !token.WaitTimeout(time.Second) {
+		t.Fatal("unable to publish stale state")
+	}
+	r.waitFor(t, DefaultPrefix+"/gone1/state", StateOnline)
+	gone.Close()
+	for svc.Device("gone1").Connected() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	b := New(svc, mqtt.NewClientOptions().AddBroker(broker).SetClientID("bridge"))
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	r.waitFor(t, DefaultPrefix+"/bridge/state", StateOnline)
+	r.waitFor(t, DefaultPrefix+"/relay1/state", StateOnline)
+	r.waitFor(t, DefaultPrefix+"/relay1/relay.0", "false")
+	r.waitFor(t, DefaultPrefix+"/gone1/state", StateOffline)
+
+	// a set from the broker reaches the device and its change comes back
+	if token := r.client.Publish(DefaultPrefix+"/relay1/relay.0/set", 1, false, "true"); !token.WaitTimeout(time.Second) {
+		t.Fatal("unable to publish set")
+	}
+	r.waitFor(t, DefaultPrefix+"/relay1/relay.0", "true")
+	if v, _ := relay.Attr("relay.0"); v != "true" {
+		t.Fatalf("device relay.0 = %q, want true", v)
+	}
+
+	relay.Close()
+	r.waitFor(t, DefaultPrefix+"/relay1/state", StateOffline)
+
+	b.Close()
+	r.waitFor(t, DefaultPrefix+"/bridge/state", StateOffline)
+}
@@ -0,0 +1,312 @@
+package iotfwdrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pborges/iotfwdrv/proto"
+	"golang.org/x/net/ipv4"
+)
+
+// MulticastGroup is where the firmware listens for discovery probes and
+// answers them
+var MulticastGroup = &net.UDPAddr{IP: net.IPv4(226, 1, 13, 37), Port: 5000}
+
+// DefaultMulticastTimeout is how long Discover waits for replies unless
+// overridden
+const DefaultMulticastTimeout = 2 * time.Second
+
+// DefaultMulticastInterval is how often Watch probes unless overridden
+const DefaultMulticastInterval = time.Minute
+
+const (
+	multicastProbe    = "iotfw discover"
+	multicastReply    = "iotfw found "
+	maxMulticastReply = 1024
+)
+
+// MalformedReplyError is reported for a found reply that cannot be turned
+// into Metadata
+type MalformedReplyError struct {
+	Addr  *net.UDPAddr
+	Reply string
+	Err   error
+}
+
+func (e *MalformedReplyError) Error() string {
+	return fmt.Sprintf("malformed multicast reply from %s %q: %v", e.Addr, e.Reply, e.Err)
+}
+
+func (e *MalformedReplyError) Unwrap() error {
+	return e.Err
+}
+
+// MulticastDiscoverer finds devices by sending "iotfw discover" to a
+// multicast group and collecting the "iotfw found" replies. Replies are
+// deduplicated by device ID.
+type MulticastDiscoverer struct {
+	// Group defaults to MulticastGroup
+	Group *net.UDPAddr
+	// Interface to probe on, the system default when nil
+	Interface *net.Interface
+	// Timeout is how long Discover waits for replies
+	Timeout time.Duration
+	Log     *slog.Logger
+	// OnFound is called for a new device and again whenever its reply
+	// changes. OnError is called with a *MalformedReplyError for replies that
+	// cannot be parsed. Both are called from a single goroutine.
+	OnFound func(m MetadataAndAddr)
+	OnError func(err error)
+}
+
+func (d *MulticastDiscoverer) log() *slog.Logger {
+	if d.Log != nil {
+		return d.Log
+	}
+	return discardLogger
+}
+
+func (d *MulticastDiscoverer) group() *net.UDPAddr {
+	if d.Group != nil {
+		return d.Group
+	}
+	return MulticastGroup
+}
+
+func (d *MulticastDiscoverer) timeout() time.Duration {
+	if d.Timeout > 0 {
+		return d.Timeout
+	}
+	return DefaultMulticastTimeout
+}
+
+// Discover probes once and returns every device that answered within Timeout,
+// sorted by ID. A cancelled ctx returns what was found so far with ctx.Err().
+func (d *MulticastDiscoverer) Discover(ctx context.Context) ([]MetadataAndAddr, error) {
+	conns, err := d.listen()
+	if err != nil {
+		return nil, err
+	}
+	defer conns.close()
+	stop := context.AfterFunc(ctx, conns.close)
+	defer stop()
+
+	deadline := time.Now().Add(d.timeout())
+	for _, conn := range []*net.UDPConn{conns.group, conns.unicast} {
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.probe(conns); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]MetadataAndAddr)
+	err = d.read(conns, seen)
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	} else if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = nil
+	}
+
+	devs := make([]MetadataAndAddr, 0, len(seen))
+	for _, m := range seen {
+		devs = append(devs, m)
+	}
+	sort.Slice(devs, func(i, j int) bool {
+		return devs[i].ID < devs[j].ID
+	})
+	return devs, err
+}
+
+// Watch probes every interval, or every DefaultMulticastInterval when interval
+// is not positive, until ctx is done, reporting devices through OnFound. It
+// returns an error only if the group could not be joined.
+func (d *MulticastDiscoverer) Watch(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		interval = DefaultMulticastInterval
+	}
+	conns, err := d.listen()
+	if err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, conns.close)
+	d.watch(ctx, conns, interval)
+	return nil
+}
+
+// watch starts probing on conns and reading the replies, probing stops as
+// soon as reading does
+func (d *MulticastDiscoverer) watch(ctx context.Context, conns *multicastConns, interval time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := d.probe(conns); err != nil {
+				d.log().Warn("unable to send multicast probe", "err", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	go func() {
+		defer close(done)
+		err := d.read(conns, make(map[string]MetadataAndAddr))
+		if ctx.Err() == nil {
+			d.log().Error("multicast discovery stopped", "err", err)
+		}
+	}()
+}
+
+// multicastConns receives replies sent back to the group on group and replies
+// sent to the prober on unicast, the probe is sent from unicast. A socket
+// bound to the group address is never handed unicast datagrams.
+type multicastConns struct {
+	group   *net.UDPConn
+	unicast *net.UDPConn
+}
+
+func (c *multicastConns) close() {
+	c.group.Close()
+	c.unicast.Close()
+}
+
+func (d *MulticastDiscoverer) listen() (*multicastConns, error) {
+	group, err := net.ListenMulticastUDP("udp4", d.Interface, d.group())
+	if err != nil {
+		return nil, fmt.Errorf("unable to join multicast group %s: %w", d.group(), err)
+	}
+	unicast, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		group.Close()
+		return nil, fmt.Errorf("unable to listen for multicast replies: %w", err)
+	}
+	if d.Interface != nil {
+		if err := ipv4.NewPacketConn(unicast).SetMulticastInterface(d.Interface); err != nil {
+			group.Close()
+			unicast.Close()
+			return nil, fmt.Errorf("unable to probe on %s: %w", d.Interface.Name, err)
+		}
+	}
+	return &multicastConns{group: group, unicast: unicast}, nil
+}
+
+func (d *MulticastDiscoverer) probe(conns *multicastConns) error {
+	_, err := conns.unicast.WriteToUDP([]byte(multicastProbe), d.group())
+	return err
+}
+
+type multicastPacket struct {
+	reply string
+	src   *net.UDPAddr
+}
+
+// read handles replies from both sockets until either fails, seen holds the
+// last reply of every ID. Both sockets are closed when it returns.
+func (d *MulticastDiscoverer) read(conns *multicastConns, seen map[string]MetadataAndAddr) error {
+	packets := make(chan multicastPacket)
+	errs := make(chan error, 2)
+	done := make(chan struct{})
+	defer conns.close()
+	defer close(done)
+	for _, conn := range []*net.UDPConn{conns.group, conns.unicast} {
+		go func(conn *net.UDPConn) {
+			buf := make([]byte, maxMulticastReply)
+			for {
+				n, src, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					errs <- err
+					return
+				}
+				select {
+				case packets <- multicastPacket{reply: string(buf[:n]), src: src}:
+				case <-done:
+					return
+				}
+			}
+		}(conn)
+	}
+
+	for {
+		var p multicastPacket
+		select {
+		case err := <-errs:
+			return err
+		case p = <-packets:
+		}
+		if !strings.HasPrefix(p.reply, multicastReply) {
+			continue
+		}
+		m, err := parseFoundReply(p.reply, p.src)
+		if err != nil {
+			err = &MalformedReplyError{Addr: p.src, Reply: p.reply, Err: err}
+			d.log().Warn("multicast discovery", "err", err)
+			if d.OnError != nil {
+				d.OnError(err)
+			}
+			continue
+		}
+		if prev, ok := seen[m.ID]; ok && reflect.DeepEqual(prev, m) {
+			continue
+		}
+		seen[m.ID] = m
+		d.log().Debug("multicast device found", "id", m.ID, "addr", m.Addr.String())
+		if d.OnFound != nil {
+			d.OnFound(m)
+		}
+	}
+}
+
+// parseFoundReply decodes the info arguments following "iotfw found", the
+// device is at the source address of the reply on port or DefaultPort
+func parseFoundReply(reply string, src *net.UDPAddr) (m MetadataAndAddr, err error) {
+	p, err := proto.Parse("found " + strings.TrimSpace(strings.TrimPrefix(reply, multicastReply)))
+	if err != nil {
+		return
+	}
+	if m.Metadata, err = parseInfo(p); err != nil {
+		return
+	}
+	if m.ID == "" {
+		err = errors.New("missing id")
+		return
+	}
+	m.Addr = net.TCPAddr{IP: src.IP, Port: DefaultPort}
+	if port, ok := p.Args["port"]; ok {
+		if m.Addr.Port, err = strconv.Atoi(port); err != nil {
+			err = fmt.Errorf("port: %w", err)
+		}
+	}
+	return
+}
+
+// HandleMulticast registers devices answering multicast probes sent every
+// interval until ctx is done, it returns an error only if discovery could not
+// start
+func (s *Service) HandleMulticast(ctx context.Context, iface *net.Interface, interval time.Duration) error {
+	s.log().Info("setup multicast discovery")
+
+	d := &MulticastDiscoverer{
+		Interface: iface,
+		Log:       s.Log,
+		OnFound: func(m MetadataAndAddr) {
+			go s.Register(m)
+		},
+	}
+	return d.Watch(ctx, interval)
+}
@@ -0,0 +1,107 @@
+package iotfwdrv
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// respond answers every probe on group like the firmware does, uni1 replies
+// to the prober and grp1 replies to the group
+func respond(t *testing.T, group *net.UDPAddr) {
+	t.Helper()
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		t.Skip("multicast unavailable:", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	// the group reply has to loop back to the prober on the same host
+	if err := ipv4.NewPacketConn(conn).SetMulticastLoopback(true); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, maxMulticastReply)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[:n]) != multicastProbe {
+				continue
+			}
+			conn.WriteToUDP([]byte(multicastReply+"id:uni1 model:relay hw:1.0.0 fw:2.1.3 port:5001"), src)
+			conn.WriteToUDP([]byte(multicastReply+"id:grp1 model:relay hw:1.0.0 fw:2.1.3"), group)
+		}
+	}()
+}
+
+func TestMulticastDiscover(t *testing.T) {
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 13, 37), Port: 15000}
+	respond(t, group)
+
+	d := &MulticastDiscoverer{Group: group}
+	devs, err := d.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devs) != 2 {
+		t.Fatalf("found %+v, want grp1 and uni1", devs)
+	}
+	if devs[0].ID != "grp1" || devs[0].Addr.Port != DefaultPort {
+		t.Errorf("group reply = %+v", devs[0])
+	}
+	if devs[1].ID != "uni1" || devs[1].Addr.Port != 5001 {
+		t.Errorf("unicast reply = %+v", devs[1])
+	}
+}
+
+func TestMulticastWatchDefaultInterval(t *testing.T) {
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 13, 38), Port: 15001}
+	respond(t, group)
+
+	found := make(chan string, 10)
+	d := &MulticastDiscoverer{Group: group, OnFound: func(m MetadataAndAddr) {
+		found <- m.ID
+	}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the first probe goes out right away whatever the interval
+	if err := d.Watch(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]bool{}
+	for len(ids) < 2 {
+		select {
+		case id := <-found:
+			ids[id] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("found %v, want grp1 and uni1", ids)
+		}
+	}
+}
+
+func TestMulticastWatchStopsProbing(t *testing.T) {
+	d := &MulticastDiscoverer{Group: &net.UDPAddr{IP: net.IPv4(239, 255, 13, 39), Port: 15002}}
+	conns, err := d.listen()
+	if err != nil {
+		t.Skip("multicast unavailable:", err)
+	}
+	before := runtime.NumGoroutine()
+	d.watch(context.Background(), conns, 10*time.Millisecond)
+
+	// a failed read ends discovery even though ctx is never done
+	conns.close()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running, want at most %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,25 @@
+package iotfwdrv
+
+import "time"
+
+// Observer is told about driver activity so it can be exported as metrics.
+// Implementations must be safe for concurrent use and return quickly, they
+// are called inline on the hot paths. A Service hands its Observer to every
+// Device it creates.
+type Observer interface {
+	// ObserveWrite is called once a command is answered, fails or times out
+	ObserveWrite(info Metadata, cmd string, elapsed time.Duration, err error)
+	// ObserveConnect is called for every connect attempt made by a Service
+	ObserveConnect(info Metadata, err error)
+	// ObserveSlowSubscriber is called when a subscription is closed with
+	// ErrSlowSubscriber
+	ObserveSlowSubscriber(filter string)
+	// ObserveScan is called when Service.ScanAndRegister finishes
+	ObserveScan(elapsed time.Duration, found int, err error)
+}
+
+func (dev *Device) observeWrite(cmd string, start time.Time, err error) {
+	if dev.Observer != nil {
+		dev.Observer.ObserveWrite(dev.info, cmd, time.Since(start), err)
+	}
+}
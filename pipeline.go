@@ -0,0 +1,133 @@
+package iotfwdrv
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pborges/iotfwdrv/proto"
+)
+
+// CapRequestID is advertised in the caps argument of the info response by
+// firmware that accepts a rid argument on any command and echoes it on every
+// line of the response, which lets several commands be in flight at once
+const CapRequestID = "rid"
+
+type pendingRequest struct {
+	cmd  string
+	conn io.Closer
+	res  []proto.Packet
+	done chan error
+}
+
+func hasCap(caps string, capability string) bool {
+	for _, c := range strings.Split(caps, ",") {
+		if strings.TrimSpace(c) == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// send writes cmd tagged with a fresh request id without waiting for the
+// response, it must run in exec so lines are never interleaved
+func (dev *Device) send(cmd proto.Packet) (id uint64, req *pendingRequest, err error) {
+	if !dev.connected.Load() {
+		err = ErrNotConnected
+		return
+	}
+	id = atomic.AddUint64(&dev.nextRequestID, 1)
+	cmd.ID = id
+	req = &pendingRequest{
+		cmd:  cmd.Cmd,
+		conn: dev.conn,
+		done: make(chan error, 1),
+	}
+	dev.pendingLock.Lock()
+	dev.pending[id] = req
+	dev.pendingLock.Unlock()
+
+	dev.log().Debug("write", "cmd", cmd.Cmd, "line", cmd.String())
+	if err = dev.encoder.Encode(cmd); err != nil {
+		dev.forget(id)
+		err = fmt.Errorf("unable to write data %w", err)
+		return 0, nil, err
+	}
+	return
+}
+
+// await blocks until the device answers req, on timeout the connection is
+// considered dead and closed
+func (dev *Device) await(ctx context.Context, id uint64, req *pendingRequest) ([]proto.Packet, error) {
+	timeout := time.NewTimer(dev.responseTimeout(ctx))
+	select {
+	case err := <-req.done:
+		timeout.Stop()
+		return req.res, err
+	case <-ctx.Done():
+		// keep listening in the background so an unanswered request still
+		// marks the device dead while an answered one leaves it alone
+		go func() {
+			defer timeout.Stop()
+			select {
+			case <-req.done:
+			case <-timeout.C:
+				dev.forget(id)
+				req.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("%s: %w", req.cmd, ctx.Err())
+	case <-timeout.C:
+		dev.forget(id)
+		req.conn.Close()
+		return nil, ErrTimeout
+	}
+}
+
+func (dev *Device) forget(id uint64) {
+	dev.pendingLock.Lock()
+	defer dev.pendingLock.Unlock()
+	delete(dev.pending, id)
+}
+
+// route hands a response packet to the request it answers, it reports false
+// for packets without a request id which belong to the lock-step path
+func (dev *Device) route(p proto.Packet) bool {
+	if p.ID == 0 {
+		return false
+	}
+
+	dev.pendingLock.Lock()
+	req, ok := dev.pending[p.ID]
+	if ok && (p.Cmd == "ok" || p.Cmd == "err") {
+		delete(dev.pending, p.ID)
+	}
+	dev.pendingLock.Unlock()
+
+	if !ok {
+		dev.log().Warn("discarding response to unknown request", "cmd", p.Cmd, "line", p.String())
+		return true
+	}
+	switch p.Cmd {
+	case "ok":
+		req.done <- nil
+	case "err":
+		req.done <- fmt.Errorf("error from device %s", p.Args["msg"])
+	default:
+		req.res = append(req.res, p)
+	}
+	return true
+}
+
+// failPending aborts every outstanding pipelined request with err
+func (dev *Device) failPending(err error) {
+	dev.pendingLock.Lock()
+	defer dev.pendingLock.Unlock()
+	for id, req := range dev.pending {
+		req.done <- err
+		delete(dev.pending, id)
+	}
+}
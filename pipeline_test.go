@@ -0,0 +1,174 @@
+package iotfwdrv_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pborges/iotfwdrv"
+	"github.com/pborges/iotfwdrv/iotfwtest"
+	"github.com/pborges/iotfwdrv/proto"
+)
+
+// gate is a command handler that answers with msg once released
+type gate struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newGate(t *testing.T, fake *iotfwtest.Device, cmd string, msg string) *gate {
+	g := &gate{started: make(chan struct{}, 10), release: make(chan struct{})}
+	fake.Handle(cmd, func(args map[string]string) ([]proto.Packet, error) {
+		g.started <- struct{}{}
+		<-g.release
+		return []proto.Packet{iotfwtest.Output(msg)}, nil
+	})
+	t.Cleanup(g.open)
+	return g
+}
+
+func (g *gate) open() {
+	select {
+	case <-g.release:
+	default:
+		close(g.release)
+	}
+}
+
+func (g *gate) waitStarted(t *testing.T) {
+	t.Helper()
+	select {
+	case <-g.started:
+	case <-time.After(time.Second):
+		t.Fatal("command never reached the device")
+	}
+}
+
+type result struct {
+	res iotfwdrv.Response
+	err error
+}
+
+func execute(ctx context.Context, dev *iotfwdrv.Device, cmd string) chan result {
+	c := make(chan result, 1)
+	go func() {
+		res, err := dev.ExecuteContext(ctx, cmd, nil)
+		c <- result{res, err}
+	}()
+	return c
+}
+
+func wait(t *testing.T, c chan result) result {
+	t.Helper()
+	select {
+	case r := <-c:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("command never returned")
+	}
+	return result{}
+}
+
+func pipelined(t *testing.T) (*iotfwtest.Device, *iotfwdrv.Device) {
+	t.Helper()
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	fake.Pipelining = true
+	return fake, connect(t, fake)
+}
+
+func TestPipelineOutOfOrder(t *testing.T) {
+	fake, dev := pipelined(t)
+	first := newGate(t, fake, "first", "one")
+	second := newGate(t, fake, "second", "two")
+
+	firstDone := execute(context.Background(), dev, "first")
+	first.waitStarted(t)
+	secondDone := execute(context.Background(), dev, "second")
+	second.waitStarted(t)
+
+	// answer the later command first, each response must reach its caller
+	second.open()
+	if r := wait(t, secondDone); r.err != nil || !reflect.DeepEqual(r.res.Output, []string{"two"}) {
+		t.Fatalf("second = %+v, %v", r.res, r.err)
+	}
+	select {
+	case r := <-firstDone:
+		t.Fatalf("first returned before it was answered: %+v, %v", r.res, r.err)
+	default:
+	}
+	first.open()
+	if r := wait(t, firstDone); r.err != nil || !reflect.DeepEqual(r.res.Output, []string{"one"}) {
+		t.Fatalf("first = %+v, %v", r.res, r.err)
+	}
+}
+
+func TestPipelineTimeout(t *testing.T) {
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	fake.Pipelining = true
+	dev := iotfwdrv.New(fake.Dialer())
+	t.Cleanup(func() {
+		dev.Close()
+	})
+	dev.Timeout = 100 * time.Millisecond
+	if err := dev.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	newGate(t, fake, "hang", "late")
+	other := newGate(t, fake, "other", "late")
+
+	// a deadline past dev.Timeout gives other longer to answer, it is still in
+	// flight when hang times out and fails as soon as the connection goes
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	otherDone := execute(ctx, dev, "other")
+	other.waitStarted(t)
+	if r := wait(t, execute(context.Background(), dev, "hang")); !errors.Is(r.err, iotfwdrv.ErrTimeout) {
+		t.Fatalf("hang = %v, want ErrTimeout", r.err)
+	}
+	if r := wait(t, otherDone); r.err == nil || errors.Is(r.err, iotfwdrv.ErrTimeout) {
+		t.Fatalf("other = %v, want the disconnect error", r.err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for dev.Connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("still connected to an unresponsive device")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPipelineCancel(t *testing.T) {
+	fake, dev := pipelined(t)
+	slow := newGate(t, fake, "slow", "done")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := execute(ctx, dev, "slow")
+	slow.waitStarted(t)
+	cancel()
+	if r := wait(t, done); !errors.Is(r.err, context.Canceled) {
+		t.Fatalf("slow = %v, want context.Canceled", r.err)
+	}
+
+	// the late answer is taken in and the connection stays up
+	slow.open()
+	if _, err := dev.Execute("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !dev.Connected() {
+		t.Fatal("cancelling a command dropped the connection")
+	}
+}
+
+func TestPipelineDisconnect(t *testing.T) {
+	fake, dev := pipelined(t)
+	slow := newGate(t, fake, "slow", "done")
+
+	done := execute(context.Background(), dev, "slow")
+	slow.waitStarted(t)
+	fake.Drop()
+	if r := wait(t, done); r.err == nil || errors.Is(r.err, iotfwdrv.ErrTimeout) {
+		t.Fatalf("slow = %v, want the disconnect error", r.err)
+	}
+}
@@ -0,0 +1,96 @@
+package iotfwdrv
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pborges/iotfwdrv/proto"
+)
+
+// parseInfo reads the Metadata out of an info response, the name is only
+// present when the firmware includes it
+func parseInfo(p proto.Packet) (m Metadata, err error) {
+	m.ID = p.Args["id"]
+	m.Name = p.Args["name"]
+	m.Model = p.Args["model"]
+	if m.HardwareVer, err = ParseVersion(p.Args["hw"]); err != nil {
+		err = fmt.Errorf("hw version: %w", err)
+		return
+	}
+	if m.FirmwareVer, err = ParseVersion(p.Args["fw"]); err != nil {
+		err = fmt.Errorf("fw version: %w", err)
+	}
+	return
+}
+
+// ProbeInfo dials addr, asks for info and hangs up. Unlike Connect it does not
+// download the attributes, subscribe or leave a Device behind, which makes it
+// cheap enough to run against every host of a network. The whole exchange is
+// bounded by timeout. Name is empty unless the firmware reports it in info.
+func ProbeInfo(ctx context.Context, addr string, timeout time.Duration) (m MetadataAndAddr, err error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	if err = proto.NewEncoder(conn).Encode(proto.Packet{Cmd: "info"}); err != nil {
+		err = fmt.Errorf("unable to write data %w", err)
+		return
+	}
+
+	var info *proto.Packet
+	decoder := proto.NewDecoder(conn)
+	for {
+		var p proto.Packet
+		p, err = decoder.Decode()
+		if err != nil {
+			var syntaxErr *proto.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				continue
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return
+		}
+		switch p.Cmd {
+		case "info":
+			if info == nil {
+				info = &p
+			}
+		case "ok":
+			if info == nil {
+				err = errors.New("unexpected info response length")
+				return
+			}
+			if m.Metadata, err = parseInfo(*info); err != nil {
+				return
+			}
+			m.Addr = *conn.RemoteAddr().(*net.TCPAddr)
+			return
+		case "err":
+			err = fmt.Errorf("error from device %s", p.Args["msg"])
+			return
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Package proto implements the iotfw line protocol.
+//
+// Every packet is a single line made of a command followed by space separated
+// key:value arguments. Keys and values containing spaces, quotes, colons or
+// control characters are wrapped in double quotes, inside quotes a backslash
+// starts an escape: \" \\ \n \r \t \xNN (raw byte) or \uNNNN. Unknown escapes
+// and backslashes outside quotes are kept literally so lines from older
+// firmware decode as they always have.
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// ArgRequestID carries Packet.ID on the wire
+const ArgRequestID = "rid"
+
+// Packet is a single line of the protocol, ID is zero for packets that are
+// not tagged with a request id
+type Packet struct {
+	ID   uint64
+	Cmd  string
+	Args map[string]string
+}
+
+func (p Packet) String() string {
+	return Format(p)
+}
+
+// SyntaxError reports where a line failed to parse, Line is only set by a
+// Decoder and Column counts bytes from 1
+type SyntaxError struct {
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Err)
+	}
+	return fmt.Sprintf("column %d: %s", e.Column, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+var ErrUnclosedQuote = errors.New("unclosed quote")
+var ErrSpaceInKey = errors.New("unexpected space in key")
+var ErrInvalidEscape = errors.New("invalid escape")
+
+type tokenizerState int
+
+const (
+	tokDecodeCommand tokenizerState = iota
+	tokDecodeKey
+	tokDecodeValue
+)
+
+// Parse decodes a single line without its trailing newline
+func Parse(line string) (Packet, error) {
+	var state tokenizerState
+	var key string
+	var tok strings.Builder
+	var inQuote bool
+	var quoteAt int
+
+	p := Packet{
+		Args: make(map[string]string),
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if inQuote {
+			switch c {
+			case '"':
+				inQuote = false
+			case '\\':
+				n, err := unescape(&tok, line[i+1:])
+				if err != nil {
+					return p, &SyntaxError{Column: i + 1, Err: fmt.Errorf("%w: %s", ErrInvalidEscape, err)}
+				}
+				i += n
+			default:
+				tok.WriteByte(c)
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inQuote = true
+			quoteAt = i
+		case ' ':
+			switch state {
+			case tokDecodeCommand:
+				p.Cmd = tok.String()
+				state = tokDecodeKey
+			case tokDecodeKey:
+				if tok.Len() > 0 {
+					return p, &SyntaxError{Column: i + 1, Err: ErrSpaceInKey}
+				}
+			case tokDecodeValue:
+				p.Args[key] = tok.String()
+				key = ""
+				state = tokDecodeKey
+			}
+			tok.Reset()
+		case ':':
+			if state == tokDecodeKey {
+				key = tok.String()
+				tok.Reset()
+				state = tokDecodeValue
+			} else {
+				tok.WriteByte(c)
+			}
+		default:
+			tok.WriteByte(c)
+		}
+	}
+	if inQuote {
+		return p, &SyntaxError{Column: quoteAt + 1, Err: ErrUnclosedQuote}
+	}
+	switch state {
+	case tokDecodeCommand:
+		p.Cmd = tok.String()
+	case tokDecodeKey:
+		if tok.Len() > 0 {
+			p.Args[tok.String()] = ""
+		}
+	case tokDecodeValue:
+		p.Args[key] = tok.String()
+	}
+	if rid, ok := p.Args[ArgRequestID]; ok {
+		if id, err := strconv.ParseUint(rid, 10, 64); err == nil {
+			p.ID = id
+			delete(p.Args, ArgRequestID)
+		}
+	}
+	return p, nil
+}
+
+// unescape writes the escape at the start of s (just after the backslash) to
+// tok and returns how many bytes of s it consumed
+func unescape(tok *strings.Builder, s string) (int, error) {
+	if len(s) == 0 {
+		return 0, errors.New("trailing backslash")
+	}
+	switch s[0] {
+	case '"', '\\':
+		tok.WriteByte(s[0])
+	case 'n':
+		tok.WriteByte('\n')
+	case 'r':
+		tok.WriteByte('\r')
+	case 't':
+		tok.WriteByte('\t')
+	case 'x':
+		if len(s) < 3 {
+			return 0, errors.New("short \\x escape")
+		}
+		b, err := strconv.ParseUint(s[1:3], 16, 8)
+		if err != nil {
+			return 0, err
+		}
+		tok.WriteByte(byte(b))
+		return 3, nil
+	case 'u':
+		if len(s) < 5 {
+			return 0, errors.New("short \\u escape")
+		}
+		r, err := strconv.ParseUint(s[1:5], 16, 16)
+		if err != nil {
+			return 0, err
+		}
+		tok.WriteRune(rune(r))
+		return 5, nil
+	default:
+		tok.WriteByte('\\')
+		tok.WriteByte(s[0])
+	}
+	return 1, nil
+}
+
+// Format encodes p as a single line without a trailing newline, arguments
+// are sorted by key so the output is stable
+func Format(p Packet) string {
+	keys := make([]string, 0, len(p.Args))
+	for k := range p.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	s := make([]string, 0, len(keys)+2)
+	s = append(s, Quote(p.Cmd))
+	for _, k := range keys {
+		s = append(s, Quote(k)+":"+Quote(p.Args[k]))
+	}
+	if p.ID != 0 {
+		s = append(s, ArgRequestID+":"+strconv.FormatUint(p.ID, 10))
+	}
+	return strings.Join(s, " ")
+}
+
+// Quote returns str as it should appear on the wire, it is only wrapped in
+// quotes if it contains anything Parse would otherwise split on or that
+// cannot survive a line based transport
+func Quote(str string) string {
+	if !needsQuote(str) {
+		return str
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(str); {
+		r, size := utf8.DecodeRuneInString(str[i:])
+		switch {
+		case r == utf8.RuneError && size <= 1:
+			fmt.Fprintf(&b, "\\x%02x", str[i])
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString("\\n")
+		case r == '\r':
+			b.WriteString("\\r")
+		case r == '\t':
+			b.WriteString("\\t")
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, "\\u%04x", r)
+		default:
+			b.WriteString(str[i : i+size])
+		}
+		i += size
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func needsQuote(str string) bool {
+	if !utf8.ValidString(str) {
+		return true
+	}
+	for _, r := range str {
+		if r == ' ' || r == '"' || r == ':' || r < 0x20 || r == 0x7f {
+			return true
+		}
+	}
+	return false
+}
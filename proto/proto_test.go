@@ -0,0 +1,141 @@
+package proto
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// firmwareLines are lines as existing firmware writes them, unquoted values
+// and stray backslashes included, they must keep decoding the same way
+var firmwareLines = []struct {
+	line string
+	want Packet
+}{
+	{"ok", Packet{Cmd: "ok", Args: map[string]string{}}},
+	{"info id:a4cf12f00d model:relay hw:1.0.0 fw:2.1.3", Packet{Cmd: "info", Args: map[string]string{
+		"id": "a4cf12f00d", "model": "relay", "hw": "1.0.0", "fw": "2.1.3",
+	}}},
+	{`attr name:config.name value:"Garage Door"`, Packet{Cmd: "attr", Args: map[string]string{
+		"name": "config.name", "value": "Garage Door",
+	}}},
+	{`attr name:path value:C:\temp\new`, Packet{Cmd: "attr", Args: map[string]string{
+		"name": "path", "value": `C:\temp\new`,
+	}}},
+	{`err msg:"unknown \q escape"`, Packet{Cmd: "err", Args: map[string]string{
+		"msg": `unknown \q escape`,
+	}}},
+	{"@attr name:relay.0 value:true", Packet{Cmd: "@attr", Args: map[string]string{
+		"name": "relay.0", "value": "true",
+	}}},
+	{"list", Packet{Cmd: "list", Args: map[string]string{}}},
+	{"sub filter:*", Packet{Cmd: "sub", Args: map[string]string{"filter": "*"}}},
+	{"ok rid:42", Packet{ID: 42, Cmd: "ok", Args: map[string]string{}}},
+	{"attr name:led value:", Packet{Cmd: "attr", Args: map[string]string{"name": "led", "value": ""}}},
+}
+
+func TestParseFirmwareLines(t *testing.T) {
+	for _, tt := range firmwareLines {
+		p, err := Parse(tt.line)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(p, tt.want) {
+			t.Errorf("Parse(%q) = %#v, want %#v", tt.line, p, tt.want)
+		}
+	}
+}
+
+// alphabet favours the characters the encoder has to escape
+var alphabet = []string{
+	"a", "Z", "0", ".", "-", " ", ":", `"`, `\`, "\n", "\r", "\t", "\x00", "\x1f", "\x7f",
+	"\xff", "\xc3", "é", "☃", "😀", "=", ",", "{", "}",
+}
+
+func randomString(r *rand.Rand) string {
+	var b strings.Builder
+	for n := r.Intn(12); n > 0; n-- {
+		b.WriteString(alphabet[r.Intn(len(alphabet))])
+	}
+	return b.String()
+}
+
+func TestFormatParseRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		p := Packet{Cmd: randomString(r), Args: make(map[string]string)}
+		if r.Intn(4) == 0 {
+			p.ID = r.Uint64()
+		}
+		for n := r.Intn(4); n > 0; n-- {
+			if k := randomString(r); k != ArgRequestID {
+				p.Args[k] = randomString(r)
+			}
+		}
+		line := Format(p)
+		if strings.ContainsAny(line, "\r\n") {
+			t.Fatalf("Format(%#v) = %q contains a line break", p, line)
+		}
+		got, err := Parse(line)
+		if err != nil {
+			t.Fatalf("Parse(Format(%#v)) = %q: %v", p, line, err)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Fatalf("Parse(%q) = %#v, want %#v", line, got, p)
+		}
+	}
+}
+
+// FuzzParse checks Parse never panics and that whatever it accepts survives
+// being formatted and parsed again
+func FuzzParse(f *testing.F) {
+	for _, tt := range firmwareLines {
+		f.Add(tt.line)
+	}
+	f.Add(`cmd "unclosed`)
+	f.Add(`cmd k:"\x4"`)
+	f.Add(`cmd k:"\u12"`)
+	f.Add(`cmd k:"trailing\`)
+	f.Add(`cmd bad key:v`)
+	f.Fuzz(func(t *testing.T, line string) {
+		p, err := Parse(line)
+		if err != nil {
+			return
+		}
+		again, err := Parse(Format(p))
+		if err != nil {
+			t.Fatalf("Parse(Format(%#v)): %v", p, err)
+		}
+		if !reflect.DeepEqual(again, p) {
+			t.Fatalf("Parse(Format(%#v)) = %#v", p, again)
+		}
+	})
+}
+
+// FuzzRoundTrip checks any single argument packet survives Format and Parse
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("attr", "value", "Garage Door", uint64(0))
+	f.Add("set", "json", `{"a":"b\n"}`, uint64(7))
+	f.Add("attr", "path", `C:\temp\new`, uint64(0))
+	f.Add("", "", "", uint64(0))
+	f.Add("a b", "k:k", "\x00\xff☃", uint64(1<<63))
+	f.Fuzz(func(t *testing.T, cmd string, key string, value string, id uint64) {
+		if key == ArgRequestID {
+			t.Skip()
+		}
+		p := Packet{ID: id, Cmd: cmd, Args: map[string]string{key: value}}
+		line := Format(p)
+		if strings.ContainsAny(line, "\r\n") {
+			t.Fatalf("Format(%#v) = %q contains a line break", p, line)
+		}
+		got, err := Parse(line)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", line, err)
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Fatalf("Parse(%q) = %#v, want %#v", line, got, p)
+		}
+	})
+}
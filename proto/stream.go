@@ -0,0 +1,124 @@
+package proto
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxLineLength bounds a line read by a Decoder unless overridden
+const DefaultMaxLineLength = 4096
+
+var ErrLineTooLong = errors.New("line too long")
+
+// Encoder writes packets to an io.Writer one line at a time, it is safe for
+// concurrent use
+type Encoder struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (e *Encoder) Encode(p Packet) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	_, err := io.WriteString(e.w, Format(p)+"\n")
+	return err
+}
+
+// Decoder reads packets from an io.Reader. Blank lines are skipped, a line
+// that fails to parse or exceeds MaxLineLength returns a *SyntaxError and
+// decoding resumes with the next line.
+type Decoder struct {
+	// MaxLineLength in bytes excluding the line terminator, zero means
+	// DefaultMaxLineLength and a negative value disables the limit
+	MaxLineLength int
+	r             *bufio.Reader
+	line          int
+	text          string
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode returns the next packet, io.EOF once the reader is exhausted
+func (d *Decoder) Decode() (Packet, error) {
+	for {
+		line, err := d.readLine()
+		if err != nil {
+			return Packet{}, err
+		}
+
+		trimmed := strings.TrimLeft(line, " \t")
+		offset := len(line) - len(trimmed)
+		trimmed = strings.TrimRight(trimmed, " \t\r")
+		d.text = trimmed
+		if trimmed == "" {
+			continue
+		}
+
+		p, err := Parse(trimmed)
+		if err != nil {
+			var syntaxErr *SyntaxError
+			if errors.As(err, &syntaxErr) {
+				syntaxErr.Line = d.line
+				syntaxErr.Column += offset
+			}
+			return p, err
+		}
+		return p, nil
+	}
+}
+
+// Line returns the text of the line last returned by Decode, useful to log
+// lines that failed to parse
+func (d *Decoder) Line() string {
+	return d.text
+}
+
+func (d *Decoder) maxLineLength() int {
+	if d.MaxLineLength == 0 {
+		return DefaultMaxLineLength
+	}
+	return d.MaxLineLength
+}
+
+// readLine returns the next line without its terminator, an over long line is
+// consumed entirely and reported as a *SyntaxError
+func (d *Decoder) readLine() (string, error) {
+	max := d.maxLineLength()
+	var buf []byte
+	var tooLong bool
+	for {
+		chunk, err := d.r.ReadSlice('\n')
+		if !tooLong {
+			buf = append(buf, chunk...)
+			// allow for a \r\n terminator before deciding
+			if max >= 0 && len(buf) > max+2 {
+				tooLong = true
+				buf = nil
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil && (err != io.EOF || (len(buf) == 0 && !tooLong)) {
+			return "", err
+		}
+		break
+	}
+	d.line++
+
+	line := strings.TrimRight(string(buf), "\r\n")
+	if tooLong || (max >= 0 && len(line) > max) {
+		d.text = ""
+		return "", &SyntaxError{Line: d.line, Column: max + 1, Err: ErrLineTooLong}
+	}
+	return line, nil
+}
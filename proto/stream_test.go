@@ -0,0 +1,144 @@
+package proto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeAll decodes every line of input, formatting each result as the
+// packet or the position and kind of the error it produced
+func decodeAll(t *testing.T, d *Decoder) []string {
+	t.Helper()
+	var got []string
+	for {
+		p, err := d.Decode()
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Decode: %v", err)
+			}
+			got = append(got, fmt.Sprintf("%d:%d %v", syntaxErr.Line, syntaxErr.Column, kind(err)))
+			continue
+		}
+		got = append(got, Format(p))
+	}
+}
+
+// kind returns the sentinel error err wraps
+func kind(err error) error {
+	for _, sentinel := range []error{ErrSpaceInKey, ErrUnclosedQuote, ErrInvalidEscape, ErrLineTooLong} {
+		if errors.Is(err, sentinel) {
+			return sentinel
+		}
+	}
+	return err
+}
+
+func TestDecoderColumns(t *testing.T) {
+	input := strings.Join([]string{
+		"ok",
+		"",
+		"cmd bad key:v",
+		"  \tcmd bad key:v",
+		`x k:"abc`,
+		`x k:"\x4"`,
+		"  ok rid:7  ",
+	}, "\n")
+	want := []string{
+		"ok",
+		"3:8 " + ErrSpaceInKey.Error(),
+		"4:11 " + ErrSpaceInKey.Error(),
+		"5:5 " + ErrUnclosedQuote.Error(),
+		"6:6 " + ErrInvalidEscape.Error(),
+		"ok rid:7",
+	}
+	if got := decodeAll(t, NewDecoder(strings.NewReader(input))); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+}
+
+func TestDecoderLineLength(t *testing.T) {
+	input := strings.Join([]string{
+		"set k:12345", // 11 bytes
+		"set k:1234",  // 10 bytes, exactly the limit
+		"set k:1234\r",
+		"ok",
+	}, "\n")
+	d := NewDecoder(strings.NewReader(input))
+	d.MaxLineLength = 10
+	want := []string{
+		"1:11 " + ErrLineTooLong.Error(),
+		"set k:1234",
+		"set k:1234",
+		"ok",
+	}
+	if got := decodeAll(t, d); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+}
+
+func TestDecoderLongLineIsSkipped(t *testing.T) {
+	// longer than the bufio buffer so it arrives in several chunks
+	long := "set k:" + strings.Repeat("x", 3*DefaultMaxLineLength)
+	d := NewDecoder(strings.NewReader(long + "\nok\n" + long))
+	want := []string{
+		"1:4097 " + ErrLineTooLong.Error(),
+		"ok",
+		"3:4097 " + ErrLineTooLong.Error(),
+	}
+	if got := decodeAll(t, d); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q\nwant %q", got, want)
+	}
+	if d.Line() != "" {
+		t.Fatalf("Line() = %q after an over long line, want empty", d.Line())
+	}
+}
+
+func TestDecoderUnlimited(t *testing.T) {
+	value := strings.Repeat("x", 2*DefaultMaxLineLength)
+	d := NewDecoder(strings.NewReader("set k:" + value))
+	d.MaxLineLength = -1
+	p, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Args["k"] != value {
+		t.Fatalf("decoded %d bytes, want %d", len(p.Args["k"]), len(value))
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	packets := []Packet{
+		{Cmd: "info", Args: map[string]string{}},
+		{ID: 3, Cmd: "set", Args: map[string]string{"name": "config.name", "value": "Garage \"Door\"\n"}},
+		{Cmd: "@attr", Args: map[string]string{"name": "relay.0", "value": "true"}},
+	}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, p := range packets {
+		if err := enc.Encode(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dec := NewDecoder(&buf)
+	for _, want := range packets {
+		got, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %#v, want %#v", got, want)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Fatalf("Decode after the last packet = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,82 @@
+package iotfwdrv
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy decides how long the Service waits before redialing a device
+// that failed to connect, attempt starts at 1 and is reset after every
+// successful connection. Returning false gives up on the device until it is
+// registered again.
+type ReconnectPolicy interface {
+	NextDelay(attempt int) (time.Duration, bool)
+}
+
+// DefaultReconnectPolicy is used by a Service without a ReconnectPolicy
+var DefaultReconnectPolicy ReconnectPolicy = ConstantBackoff{Delay: 5 * time.Second}
+
+// ConstantBackoff waits the same Delay between every attempt
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+func (b ConstantBackoff) NextDelay(attempt int) (time.Duration, bool) {
+	return b.Delay, true
+}
+
+// ExponentialBackoff multiplies Initial by Multiplier for every failed attempt
+// up to Max, Jitter (0-1) randomly shortens each delay by up to that fraction
+// so devices that dropped together do not redial in lockstep
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+	Jitter     float64
+}
+
+func (b ExponentialBackoff) NextDelay(attempt int) (time.Duration, bool) {
+	initial := b.Initial
+	if initial <= 0 {
+		initial = time.Second
+	}
+	max := b.Max
+	if max <= 0 {
+		max = 5 * time.Minute
+	}
+	multiplier := b.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := float64(initial) * math.Pow(multiplier, float64(attempt-1))
+	if delay > float64(max) {
+		delay = float64(max)
+	}
+	if b.Jitter > 0 {
+		jitter := math.Min(b.Jitter, 1)
+		delay -= delay * jitter * rand.Float64()
+	}
+	return time.Duration(delay), true
+}
+
+// GiveUpAfter defers to Policy for the first Attempts attempts and then gives up
+type GiveUpAfter struct {
+	Attempts int
+	Policy   ReconnectPolicy
+}
+
+func (g GiveUpAfter) NextDelay(attempt int) (time.Duration, bool) {
+	if attempt > g.Attempts {
+		return 0, false
+	}
+	policy := g.Policy
+	if policy == nil {
+		policy = DefaultReconnectPolicy
+	}
+	return policy.NextDelay(attempt)
+}
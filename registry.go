@@ -0,0 +1,230 @@
+package iotfwdrv
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RegistryEntry is a device remembered by a RegistryStore
+type RegistryEntry struct {
+	MetadataAndAddr
+	LastSeen time.Time
+}
+
+// RegistryStore persists the devices a Service has registered so they can be
+// registered again after a restart without waiting for discovery
+type RegistryStore interface {
+	List() ([]RegistryEntry, error)
+	// Put adds or replaces the entry with the same ID
+	Put(e RegistryEntry) error
+	Delete(id string) error
+}
+
+// FileRegistry is a RegistryStore kept in a single JSON file, every change
+// rewrites the file atomically
+type FileRegistry struct {
+	path string
+	lock sync.Mutex
+}
+
+func NewFileRegistry(path string) *FileRegistry {
+	return &FileRegistry{path: path}
+}
+
+func (r *FileRegistry) List() ([]RegistryEntry, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entries, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]RegistryEntry, 0, len(entries))
+	for _, e := range entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+func (r *FileRegistry) Put(e RegistryEntry) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entries, err := r.load()
+	if err != nil {
+		return err
+	}
+	entries[e.ID] = e
+	return r.save(entries)
+}
+
+func (r *FileRegistry) Delete(id string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	entries, err := r.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := entries[id]; !ok {
+		return nil
+	}
+	delete(entries, id)
+	return r.save(entries)
+}
+
+// load reads the file, a missing file is an empty registry
+func (r *FileRegistry) load() (map[string]RegistryEntry, error) {
+	entries := make(map[string]RegistryEntry)
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// save writes to a temporary file and renames it over the registry so a
+// crash never leaves a truncated file behind
+func (r *FileRegistry) save(entries map[string]RegistryEntry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// Restore registers every device in s.Registry in the background, entries not
+// seen for longer than s.RegistryMaxAge are deleted instead. Devices that
+// cannot be reached are retried with the reconnect policy until they connect,
+// are registered some other way or age out.
+func (s *Service) Restore() error {
+	if s.Registry == nil {
+		return nil
+	}
+	entries, err := s.Registry.List()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if s.expired(e) {
+			s.log().Info("pruning device from registry", "id", e.ID, "name", e.Name, "last_seen", e.LastSeen)
+			if err := s.Registry.Delete(e.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		s.log().Info("restoring device from registry", "id", e.ID, "name", e.Name, "addr", e.Addr.String())
+		go s.restore(e)
+	}
+	return nil
+}
+
+func (s *Service) restore(e RegistryEntry) {
+	resolve := func() (MetadataAndAddr, *DeviceConfig, error) {
+		var cfg *DeviceConfig
+		s.exec(func() {
+			cfg = s.configFor(e.MetadataAndAddr)
+		})
+		return e.MetadataAndAddr, cfg, nil
+	}
+	wanted := func() bool {
+		if dev := s.Device(e.ID); dev != nil {
+			return false
+		}
+		if s.expired(e) {
+			s.log().Info("pruning device from registry", "id", e.ID, "name", e.Name, "last_seen", e.LastSeen)
+			if err := s.Registry.Delete(e.ID); err != nil {
+				s.log().Warn("unable to update registry", "id", e.ID, "err", err)
+			}
+			return false
+		}
+		return true
+	}
+	s.registerUntil(resolve, s.reconnectPolicy(), wanted)
+}
+
+func (s *Service) expired(e RegistryEntry) bool {
+	return s.RegistryMaxAge > 0 && time.Since(e.LastSeen) > s.RegistryMaxAge
+}
+
+// registryRefresh is how often a connected device is recorded as seen, often
+// enough that it never ages out however long it stays connected
+func (s *Service) registryRefresh() time.Duration {
+	refresh := time.Hour
+	if s.RegistryMaxAge > 0 && s.RegistryMaxAge/2 < refresh {
+		refresh = s.RegistryMaxAge / 2
+	}
+	return refresh
+}
+
+// remember records ctx in s.Registry as seen now
+func (s *Service) remember(ctx *DeviceContext) {
+	if s.Registry == nil {
+		return
+	}
+	addr := ctx.Addr()
+	if addr == nil {
+		return
+	}
+	err := s.Registry.Put(RegistryEntry{
+		MetadataAndAddr: MetadataAndAddr{
+			Metadata: ctx.Info(),
+			Addr:     *addr,
+		},
+		LastSeen: time.Now(),
+	})
+	if err != nil {
+		s.deviceLog(ctx).Warn("unable to update registry", "err", err)
+	}
+}
+
+// refreshRegistry records ctx as seen every registryRefresh until stop is
+// called, a device that stays connected is still seen
+func (s *Service) refreshRegistry(ctx *DeviceContext) (stop func()) {
+	if s.Registry == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.registryRefresh())
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.remember(ctx)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
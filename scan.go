@@ -1,21 +1,129 @@
 package iotfwdrv
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-func probe(addr string) (dev *Device, err error) {
-	dev = New(func() (io.ReadWriteCloser, error) {
-		return net.DialTimeout("tcp", addr, 2*time.Second)
+// DefaultScanWorkers is how many hosts a scan probes at once unless overridden
+const DefaultScanWorkers = 64
+
+// DefaultScanTimeout bounds dialing and identifying a single host
+const DefaultScanTimeout = 2 * time.Second
+
+// MaxScanHosts refuses networks that would take unreasonably long to probe
+const MaxScanHosts = 1 << 16
+
+var ErrNetworkTooLarge = errors.New("network too large to scan")
+
+// DefaultScanProgressInterval is how often OnProgress is called unless overridden
+const DefaultScanProgressInterval = time.Second
+
+// ScanOptions configures ScanContext, zero values select the defaults
+type ScanOptions struct {
+	// Networks to probe, any IPv4 prefix length, LocalNetworks when empty
+	Networks []*net.IPNet
+	// Ports probed on every host, DefaultPort when empty
+	Ports   []int
+	Timeout time.Duration
+	Workers int
+	// FullHandshake identifies hosts with a complete Connect, downloading
+	// every attribute, instead of only asking for info. Only needed to learn
+	// the names of devices whose firmware leaves it out of info.
+	FullHandshake bool
+	// OnFound is called as soon as a device answers, OnProgress every
+	// ProgressInterval and once more when the scan ends. Both are called from
+	// a single goroutine and slow the scan down while they run.
+	OnFound          func(m MetadataAndAddr)
+	OnProgress       func(p ScanProgress)
+	ProgressInterval time.Duration
+}
+
+// ScanProgress counts the addresses probed so far, an address is a host and
+// port pair. The error counts add up to Probed minus Found.
+type ScanProgress struct {
+	Probed      int
+	Total       int
+	Found       int
+	Refused     int
+	Timeout     int
+	Unreachable int
+	Other       int
+	Elapsed     time.Duration
+}
+
+func (p ScanProgress) Errors() int {
+	return p.Refused + p.Timeout + p.Unreachable + p.Other
+}
+
+func (p *ScanProgress) count(err error) {
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		p.Refused++
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		p.Unreachable++
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded), isTimeout(err):
+		p.Timeout++
+	default:
+		p.Other++
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (o ScanOptions) ports() []int {
+	if len(o.Ports) > 0 {
+		return o.Ports
+	}
+	return []int{DefaultPort}
+}
+
+func (o ScanOptions) timeout() time.Duration {
+	if o.Timeout > 0 {
+		return o.Timeout
+	}
+	return DefaultScanTimeout
+}
+
+func (o ScanOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	return DefaultScanWorkers
+}
+
+// probe identifies the device at addr, with full set it performs the whole
+// Connect handshake instead of only asking for info
+func probe(ctx context.Context, addr string, timeout time.Duration, full bool) (MetadataAndAddr, error) {
+	if !full {
+		return ProbeInfo(ctx, addr, timeout)
+	}
+	dev := New(func() (io.ReadWriteCloser, error) {
+		d := net.Dialer{Timeout: timeout}
+		return d.DialContext(ctx, "tcp", addr)
 	})
-	err = dev.Connect()
-	return
+	defer dev.Close()
+	dev.Timeout = timeout
+	if err := dev.ConnectContext(ctx); err != nil {
+		return MetadataAndAddr{}, err
+	}
+	return MetadataAndAddr{
+		Metadata: dev.Info(),
+		Addr:     *dev.Addr(),
+	}, nil
 }
 
 type IPError struct {
@@ -29,65 +137,185 @@ func (e IPErrors) Error() string {
 	return fmt.Sprintf("%d endpoints returned an error", len(e))
 }
 
+// Scan probes DefaultPort on every host of the /24 containing each of networks
 func Scan(networks ...net.IP) (devs []MetadataAndAddr, err error) {
+	nets := make([]*net.IPNet, 0, len(networks))
+	for _, n := range networks {
+		mask := net.CIDRMask(24, 32)
+		nets = append(nets, &net.IPNet{IP: n.To4().Mask(mask), Mask: mask})
+	}
+	return ScanContext(context.Background(), ScanOptions{Networks: nets})
+}
+
+// ScanContext probes every host and port described by opts and returns the
+// devices found sorted by ID. Hosts that did not answer are reported as
+// IPErrors, a cancelled ctx returns what was found so far with ctx.Err().
+// Set opts.OnFound and opts.OnProgress to follow a long scan as it runs.
+func ScanContext(ctx context.Context, opts ScanOptions) (devs []MetadataAndAddr, err error) {
+	networks := opts.Networks
+	if len(networks) == 0 {
+		if networks, err = LocalNetworks(); err != nil {
+			return
+		}
+	}
+	var total int
+	for _, n := range networks {
+		_, count, err := ipv4Range(n)
+		if err != nil {
+			return nil, err
+		}
+		total += count
+	}
+	if total > MaxScanHosts {
+		return nil, fmt.Errorf("%d hosts: %w", total, ErrNetworkTooLarge)
+	}
+
 	type res struct {
 		IP net.IP
-		*Device
+		MetadataAndAddr
 		error
 	}
 
-	addrCount := 254 * len(networks)
-
-	in := make(chan net.IP, addrCount)
+	ports := opts.ports()
+	timeout := opts.timeout()
+	in := make(chan string)
 	out := make(chan res)
 
-	// load teh queue
-	for _, network := range networks {
-		network = network.To4()
-		for i := 1; i < 255; i++ {
-			ip := net.IPv4(network[0], network[1], network[2], byte(i))
-			in <- ip
+	// feed the workers until every address is queued or ctx is done
+	go func() {
+		defer close(in)
+		for _, n := range networks {
+			for _, ip := range hosts(n) {
+				for _, port := range ports {
+					select {
+					case in <- net.JoinHostPort(ip.String(), strconv.Itoa(port)):
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
 		}
-	}
+	}()
 
-	for i := 0; i < 64; i++ {
+	wg := new(sync.WaitGroup)
+	for i := 0; i < opts.workers(); i++ {
+		wg.Add(1)
 		go func() {
-			for {
-				select {
-				case ip := <-in:
-					addr := fmt.Sprintf("%s:%d", ip.To4(), 5000)
-					dev, err := probe(addr)
-					out <- res{IP: ip, Device: dev, error: fmt.Errorf("[%s] %w", addr, err)}
-				default:
-					return
+			defer wg.Done()
+			for addr := range in {
+				host, _, _ := net.SplitHostPort(addr)
+				m, err := probe(ctx, addr, timeout, opts.FullHandshake)
+				if err != nil {
+					err = fmt.Errorf("[%s] %w", addr, err)
 				}
+				out <- res{IP: net.ParseIP(host), MetadataAndAddr: m, error: err}
 			}
 		}()
 	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	progress := ScanProgress{Total: total * len(ports)}
+	start := time.Now()
+	report := func() {
+		if opts.OnProgress != nil {
+			progress.Elapsed = time.Since(start)
+			opts.OnProgress(progress)
+		}
+	}
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = DefaultScanProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	var devErr IPErrors
-	for i := 0; i < addrCount; i++ {
-		res := <-out
-		if res.Device != nil && res.Device.Connected() {
-			devs = append(devs, MetadataAndAddr{
-				Metadata: res.Device.Info(),
-				Addr:     *res.Device.Addr(),
-			})
-			_ = res.Device.Disconnect()
-		} else if res.error != nil {
-			devErr = append(devErr, IPError{IP: res.IP, error: res.error})
+collect:
+	for {
+		select {
+		case <-ticker.C:
+			report()
+			continue
+		case res, ok := <-out:
+			if !ok {
+				break collect
+			}
+			progress.Probed++
+			if res.error == nil {
+				progress.Found++
+				devs = append(devs, res.MetadataAndAddr)
+				if opts.OnFound != nil {
+					opts.OnFound(res.MetadataAndAddr)
+				}
+			} else {
+				progress.count(res.error)
+				devErr = append(devErr, IPError{IP: res.IP, error: res.error})
+			}
 		}
 	}
-	err = devErr
+	report()
 
 	sort.Slice(devs, func(i, j int) bool {
 		return strings.Compare(devs[i].ID, devs[j].ID) < 0
 	})
 
-	return
+	if ctx.Err() != nil {
+		return devs, ctx.Err()
+	}
+	if len(devErr) > 0 {
+		return devs, devErr
+	}
+	return devs, nil
+}
+
+// ipv4Range returns the first usable address of the IPv4 network n and how
+// many there are, the network and broadcast addresses are skipped
+func ipv4Range(n *net.IPNet) (first uint32, count int, err error) {
+	ip := n.IP.To4()
+	if ip == nil {
+		return 0, 0, fmt.Errorf("%s: only IPv4 networks can be scanned", n)
+	}
+	ones, bits := n.Mask.Size()
+	if bits == 128 {
+		// an IPv4 mask in its 16 byte form
+		ones, bits = ones-96, 32
+	}
+	if bits != 32 || ones < 0 {
+		return 0, 0, fmt.Errorf("%s: invalid IPv4 mask", n)
+	}
+	if bits-ones > 16 {
+		return 0, 0, fmt.Errorf("%s: %w", n, ErrNetworkTooLarge)
+	}
+	first = binary.BigEndian.Uint32(ip) &^ (1<<(bits-ones) - 1)
+	count = 1 << (bits - ones)
+	if count > 2 {
+		first++
+		count -= 2
+	}
+	return first, count, nil
+}
+
+// hosts lists the usable addresses of the IPv4 network n
+func hosts(n *net.IPNet) []net.IP {
+	first, count, err := ipv4Range(n)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, 0, count)
+	for i := 0; i < count; i++ {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, first+uint32(i))
+		ips = append(ips, ip)
+	}
+	return ips
 }
 
-func LocalNetworks() ([]net.IP, error) {
-	networksMap := make(map[string]net.IP)
+// LocalNetworks returns the IPv4 networks of every non loopback interface
+func LocalNetworks() ([]*net.IPNet, error) {
+	networksMap := make(map[string]*net.IPNet)
 	ifaces, err := net.Interfaces()
 	if err != nil {
 		return nil, err
@@ -95,21 +323,25 @@ func LocalNetworks() ([]net.IP, error) {
 	for _, i := range ifaces {
 		addrs, err := i.Addrs()
 		if err != nil {
-			log.Fatalln(err)
+			return nil, err
 		}
 		for _, addr := range addrs {
 			if a, ok := addr.(*net.IPNet); ok &&
 				!a.IP.IsLoopback() &&
 				a.IP.To4() != nil {
-				networksMap[a.IP.Mask(a.Mask).String()] = a.IP.Mask(a.Mask)
+				n := &net.IPNet{IP: a.IP.To4().Mask(a.Mask), Mask: a.Mask}
+				networksMap[n.String()] = n
 			}
 		}
 	}
 
-	networks := make([]net.IP, 0, len(networksMap))
+	networks := make([]*net.IPNet, 0, len(networksMap))
 	for _, n := range networksMap {
 		networks = append(networks, n)
 	}
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].String() < networks[j].String()
+	})
 
 	return networks, nil
 }
@@ -0,0 +1,43 @@
+package iotfwdrv_test
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pborges/iotfwdrv"
+	"github.com/pborges/iotfwdrv/iotfwtest"
+)
+
+func TestScanFullHandshake(t *testing.T) {
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	addr, err := fake.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fake.Close()
+	})
+	before := runtime.NumGoroutine()
+
+	devs, err := iotfwdrv.ScanContext(context.Background(), iotfwdrv.ScanOptions{
+		Networks:      []*net.IPNet{{IP: addr.IP, Mask: net.CIDRMask(32, 32)}},
+		Ports:         []int{addr.Port, unreachable(t).Port},
+		Timeout:       time.Second,
+		FullHandshake: true,
+	})
+	if len(devs) != 1 || devs[0].ID != "dev1" || devs[0].Addr.Port != addr.Port {
+		t.Fatalf("found %+v (%v), want dev1 at %s", devs, err, addr)
+	}
+	// every probed device is closed, connection and all
+	deadline := time.Now().Add(2 * time.Second)
+	for fake.Conns() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("scan left the connection open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	settle(t, before)
+}
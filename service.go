@@ -5,8 +5,9 @@ import (
 	"fmt"
 	"github.com/olekukonko/tablewriter"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"reflect"
 	"sort"
 	"strings"
 	"sync"
@@ -28,8 +29,13 @@ type MetadataAndAddr struct {
 
 type DeviceContext struct {
 	*Device
-	ConnectedAt time.Time
-	reconnect   bool
+	// Alias is the friendly name given to the device in the Config
+	Alias             string
+	ConnectedAt       time.Time
+	ReconnectAttempts int
+	NextReconnectAt   time.Time
+	config            *DeviceConfig
+	reconnect         bool
 }
 
 type ServicePlugin interface {
@@ -49,20 +55,27 @@ type ServicePluginOnDisconnect interface {
 }
 
 type Service struct {
-	Networks       []net.IP
-	Log            *log.Logger
-	OnRegister     func(m MetadataAndAddr)
-	OnConnect      func(ctx DeviceContext)
-	OnDisconnect   func(ctx DeviceContext, err error)
-	Plugins        []ServicePlugin
-	devices        map[string]*DeviceContext
-	fnCh           chan func()
-	subscriptions  []*Subscription
-	mdnsCancelFunc context.CancelFunc
+	Networks          []*net.IPNet
+	ScanOptions       ScanOptions
+	Log               *slog.Logger
+	ReconnectPolicy   ReconnectPolicy
+	Observer          Observer
+	Registry          RegistryStore
+	RegistryMaxAge    time.Duration
+	OnRegister        func(m MetadataAndAddr)
+	OnConnect         func(ctx DeviceContext)
+	OnDisconnect      func(ctx DeviceContext, err error)
+	Plugins           []ServicePlugin
+	devices           map[string]*DeviceContext
+	configs           map[string]DeviceConfig
+	fnCh              chan func()
+	setup             sync.Once
+	subscriptions     []*Subscription
+	subscriptionsLock sync.Mutex
 }
 
 func (s *Service) exec(fn func()) {
-	if s.fnCh == nil {
+	s.setup.Do(func() {
 		s.fnCh = make(chan func())
 		s.devices = make(map[string]*DeviceContext)
 		go func() {
@@ -70,7 +83,7 @@ func (s *Service) exec(fn func()) {
 				fn()
 			}
 		}()
-	}
+	})
 	wg := new(sync.WaitGroup)
 	wg.Add(1)
 	s.fnCh <- func() {
@@ -80,40 +93,91 @@ func (s *Service) exec(fn func()) {
 	wg.Wait()
 }
 
-func (s *Service) HandleMDNS() {
-	s.logf("setup mdns discovery")
+func (s *Service) reconnectPolicy() ReconnectPolicy {
+	if s.ReconnectPolicy != nil {
+		return s.ReconnectPolicy
+	}
+	return DefaultReconnectPolicy
+}
 
-	HandleMDNS(context.Background(), s.Register)
+func (s *Service) reconnectPolicyFor(ctx *DeviceContext) ReconnectPolicy {
+	if ctx.config != nil && ctx.config.Reconnect != nil {
+		return ctx.config.Reconnect.Policy()
+	}
+	return s.reconnectPolicy()
 }
 
-func (s *Service) logf(format string, a ...interface{}) {
+// HandleMDNS registers devices discovered over mDNS until ctx is done, it
+// returns an error only if discovery could not start
+func (s *Service) HandleMDNS(ctx context.Context) error {
+	s.log().Info("setup mdns discovery")
+
+	d := &Discoverer{
+		Log: s.Log,
+		OnFound: func(e DiscoveryEntry, m MetadataAndAddr) {
+			go s.Register(m)
+		},
+		OnGone: func(e DiscoveryEntry) {
+			s.log().Info("device left mdns", "id", e.Instance)
+		},
+	}
+	if err := d.Start(); err != nil {
+		return err
+	}
+	context.AfterFunc(ctx, func() {
+		d.Close()
+	})
+	return nil
+}
+
+func (s *Service) log() *slog.Logger {
 	if s.Log != nil {
-		s.Log.Output(2, fmt.Sprintf(format, a...))
+		return s.Log
+	}
+	return discardLogger
+}
+
+func (s *Service) deviceLog(ctx *DeviceContext) *slog.Logger {
+	attrs := []interface{}{"id", ctx.Info().ID, "name", ctx.Info().Name}
+	if addr := ctx.Addr(); addr != nil {
+		attrs = append(attrs, "addr", addr.String())
 	}
+	return s.log().With(attrs...)
 }
 
 func (s *Service) fanout(info Metadata, key string, value string) {
-	slowSubscribers := make([]*Subscription, 0, len(s.subscriptions))
 	key = fmt.Sprintf("%s.%s", info.ID, key)
+
+	s.subscriptionsLock.Lock()
+	subs := make([]*Subscription, 0, len(s.subscriptions))
 	for _, sub := range s.subscriptions {
-		if KeyMatch(key, sub.filter) {
-			select {
-			case sub.ch <- Message{
-				Device: info,
-				Key:    key,
-				Value:  value,
-			}:
-			default:
-				slowSubscribers = append(slowSubscribers, sub)
-			}
+		if sub.match(key) {
+			subs = append(subs, sub)
 		}
 	}
-	for _, sub := range slowSubscribers {
-		sub.Close()
-		s.logf("closing slow subscriber %s", sub)
+	s.subscriptionsLock.Unlock()
+
+	for _, sub := range subs {
+		if !sub.deliver(Message{
+			Device: info,
+			Key:    key,
+			Value:  value,
+		}) {
+			sub.closeWithErr(ErrSlowSubscriber)
+			s.log().Warn("closing slow subscriber", "filter", sub.Filter(), "dropped", sub.Dropped())
+			if s.Observer != nil {
+				s.Observer.ObserveSlowSubscriber(sub.Filter())
+			}
+		}
 	}
 }
 
+func (s *Service) unsubscribe(sub *Subscription) {
+	s.subscriptionsLock.Lock()
+	defer s.subscriptionsLock.Unlock()
+	s.subscriptions = removeSubscription(s.subscriptions, sub)
+}
+
 func (s *Service) Device(id string) (dev *Device) {
 	s.exec(func() {
 		if ctx, ok := s.devices[id]; ok {
@@ -124,8 +188,9 @@ func (s *Service) Device(id string) (dev *Device) {
 }
 
 func (s *Service) Devices() []*Device {
-	devs := make([]*Device, 0, len(s.devices))
+	var devs []*Device
 	s.exec(func() {
+		devs = make([]*Device, 0, len(s.devices))
 		for _, dev := range s.devices {
 			devs = append(devs, dev.Device)
 		}
@@ -133,114 +198,305 @@ func (s *Service) Devices() []*Device {
 	return devs
 }
 
+// DeviceContext returns a copy of the context tracked for id
+func (s *Service) DeviceContext(id string) (ctx DeviceContext, ok bool) {
+	s.exec(func() {
+		var c *DeviceContext
+		if c, ok = s.devices[id]; ok {
+			ctx = *c
+		}
+	})
+	return
+}
+
+// DeviceContexts returns a copy of every tracked context sorted by ID
+func (s *Service) DeviceContexts() []DeviceContext {
+	var ctxs []DeviceContext
+	s.exec(func() {
+		ctxs = make([]DeviceContext, 0, len(s.devices))
+		for _, ctx := range s.devices {
+			ctxs = append(ctxs, *ctx)
+		}
+	})
+	sort.Slice(ctxs, func(i, j int) bool {
+		return ctxs[i].Info().ID < ctxs[j].Info().ID
+	})
+	return ctxs
+}
+
+// Register dials m once and tracks it from then on, a device that cannot be
+// reached is forgotten until it is registered again
 func (s *Service) Register(m MetadataAndAddr) {
+	var cfg *DeviceConfig
 	s.exec(func() {
-		// did we create a Device for this yet? Did the IP change or something?
-		if ctx, ok := s.devices[m.ID]; ok {
-			if !ctx.Connected() || m.Addr.String() != ctx.Addr().String() {
-				s.logf("[%s:%s] unregistering device connected: %t existingIP: %s newIp: %s",
-					ctx.Info().ID,
-					ctx.Info().Name,
-					ctx.Connected(),
-					ctx.Addr().String(),
-					m.Addr.String(),
-				)
-				ctx.reconnect = false
-				ctx.Disconnect()
-				delete(s.devices, m.ID)
+		cfg = s.configFor(m)
+	})
+	if err := s.register(m, cfg); err != nil {
+		s.log().Warn("unable to connect to register device", "id", m.ID, "addr", m.Addr.String(), "err", err)
+	}
+}
+
+// registerUntil calls resolve and registers what it returns until that
+// succeeds, waiting between attempts as policy says. It gives up as soon as
+// wanted reports false.
+func (s *Service) registerUntil(resolve func() (MetadataAndAddr, *DeviceConfig, error), policy ReconnectPolicy, wanted func() bool) {
+	for attempt := 1; wanted(); attempt++ {
+		m, cfg, err := resolve()
+		if err == nil {
+			if err = s.register(m, cfg); err == nil {
+				return
 			}
 		}
+		delay, retry := policy.NextDelay(attempt)
+		if !retry {
+			s.log().Warn("giving up registering device", "id", m.ID, "addr", m.Addr.String(), "err", err, "attempts", attempt)
+			return
+		}
+		s.log().Warn("unable to connect to register device", "id", m.ID, "addr", m.Addr.String(), "err", err, "attempt", attempt, "retry_in", delay)
+		time.Sleep(delay)
+	}
+}
+
+// unregister stops reconnecting ctx, closes it and forgets it, must run in exec
+func (s *Service) unregister(ctx *DeviceContext, reason string) {
+	s.deviceLog(ctx).Info("unregistering device", "connected", ctx.Connected(), "reason", reason)
+	ctx.reconnect = false
+	ctx.Close()
+	delete(s.devices, ctx.Info().ID)
+}
+
+// register dials m and starts its connect loop, cfg is nil for a discovered
+// device without a configuration entry. The dial happens outside exec so an
+// unreachable device does not hold up the rest of the Service.
+func (s *Service) register(m MetadataAndAddr, cfg *DeviceConfig) error {
+	var known bool
+	s.exec(func() {
+		// did we create a Device for this yet? Did the IP or the configuration change?
+		ctx, ok := s.devices[m.ID]
+		if !ok {
+			return
+		}
+		// discovery knows nothing about the configuration, only ApplyConfig
+		// takes it away
+		if cfg == nil {
+			cfg = ctx.config
+		}
+		if !reflect.DeepEqual(ctx.config, cfg) {
+			s.unregister(ctx, "configuration changed")
+			return
+		}
+		if ctx.Connected() && m.Addr.String() == ctx.Addr().String() {
+			known = true
+			return
+		}
+		s.unregister(ctx, "new address "+m.Addr.String())
+	})
+	if known {
+		return nil
+	}
+
+	// attempt to dial
+	addr := m.Addr.String()
+	dialTimeout := 4 * time.Second
+	if cfg != nil {
+		addr = cfg.Addr
+		if cfg.DialTimeout > 0 {
+			dialTimeout = time.Duration(cfg.DialTimeout)
+		}
+	}
+	dev := New(func() (io.ReadWriteCloser, error) {
+		return net.DialTimeout("tcp", addr, dialTimeout)
+	})
+	dev.Observer = s.Observer
+	if cfg != nil && cfg.Timeout > 0 {
+		dev.Timeout = time.Duration(cfg.Timeout)
+	}
 
-		if _, ok := s.devices[m.ID]; !ok {
-			// attempt to dial
-			dev := New(func() (io.ReadWriteCloser, error) {
-				return net.DialTimeout("tcp", m.Addr.String(), 4*time.Second)
-			})
+	if err := dev.Connect(); err != nil {
+		dev.Close()
+		return err
+	}
+	if cfg != nil && cfg.ID != "" && dev.Info().ID != cfg.ID {
+		dev.Close()
+		return fmt.Errorf("refusing unexpected device %s at %s, expected %s", dev.Info().ID, addr, cfg.ID)
+	}
 
-			if err := dev.Connect(); err != nil {
-				s.logf("unable to connect to register device %s", err.Error())
+	s.exec(func() {
+		// a configured device without an ID may already be known through
+		// discovery, and another register may have won the race to dial
+		if old, ok := s.devices[dev.Info().ID]; ok {
+			if old.Connected() && (cfg == nil || reflect.DeepEqual(old.config, cfg)) {
+				dev.Close()
 				return
 			}
+			s.unregister(old, "registered again")
+		}
+		s.track(m, dev, cfg)
+	})
+	return nil
+}
 
-			ctx := &DeviceContext{
-				Device:    dev,
-				reconnect: true,
-			}
-			s.logf("[%s:%s] registering device", ctx.Info().ID, ctx.Info().Name)
-			s.devices[dev.Info().ID] = ctx
+// track adds a connected dev and starts its connect loop, must run in exec
+func (s *Service) track(m MetadataAndAddr, dev *Device, cfg *DeviceConfig) {
+	ctx := &DeviceContext{
+		Device:    dev,
+		config:    cfg,
+		reconnect: true,
+	}
+	if cfg != nil {
+		ctx.Alias = cfg.Alias
+	}
+	s.deviceLog(ctx).Info("registering device")
+	s.devices[dev.Info().ID] = ctx
+	// discovery may only have known part of the metadata, such as the ID
+	m.Metadata = dev.Info()
+
+	// OnRegister Callbacks, do it before we start the connect loop so they come before OnConnect callbacks
+	if s.OnRegister != nil {
+		s.OnRegister(m)
+	}
+	for _, p := range s.Plugins {
+		if fn, ok := p.(ServicePluginOnRegister); ok {
+			s.deviceLog(ctx).Debug("executing plugin", "plugin", p.ServiceName(), "hook", "OnRegister")
+			fn.OnRegister(m)
+		}
+	}
 
-			// OnRegister Callbacks, do it before we start the connect loop so they come before OnConnect callbacks
-			if s.OnRegister != nil {
-				s.OnRegister(m)
-			}
-			for _, p := range s.Plugins {
-				if fn, ok := p.(ServicePluginOnRegister); ok {
-					s.logf("executing %s->OnRegister for %s (%s)", p.ServiceName(), m.ID, m.Name)
-					fn.OnRegister(m)
-				}
+	go func(ctx *DeviceContext) {
+		// the bookkeeping on ctx is read by DeviceContexts, so it is only
+		// touched in exec
+		for s.reconnecting(ctx) {
+			connectErr := ctx.Connect()
+			if s.Observer != nil {
+				s.Observer.ObserveConnect(ctx.Info(), connectErr)
 			}
+			if connectErr == nil {
+				s.deviceLog(ctx).Info("connected")
+				s.exec(func() {
+					ctx.ConnectedAt = time.Now()
+					ctx.ReconnectAttempts = 0
+					ctx.NextReconnectAt = time.Time{}
+				})
+				s.remember(ctx)
+				s.fanout(ctx.Device.Info(), KeyEvent, KeyEventConnect)
+
+				// subscribe to everything and fanout
+				go func(ctx *DeviceContext) {
+					for m := range ctx.Subscribe(">").Chan() {
+						s.fanout(ctx.Device.Info(), m.Key, m.Value)
+					}
+				}(ctx)
 
-			go func(ctx *DeviceContext) {
-				for ctx.reconnect {
-					connectErr := ctx.Connect()
-					if connectErr == nil {
-						s.logf("[%s:%s] connected", ctx.Info().ID, ctx.Info().Name)
-						ctx.ConnectedAt = time.Now()
-						s.fanout(ctx.Device.Info(), KeyEvent, KeyEventConnect)
-
-						// subscribe to everything and fanout
-						go func(ctx *DeviceContext) {
-							for m := range ctx.Subscribe(">").Chan() {
-								s.fanout(ctx.Device.Info(), m.Key, m.Value)
-							}
-						}(ctx)
-
-						if s.OnConnect != nil {
-							s.OnConnect(*ctx)
-						}
-						for _, p := range s.Plugins {
-							if fn, ok := p.(ServicePluginOnConnect); ok {
-								s.logf("executing %s->OnConnect for %s (%s)", p.ServiceName(), dev.Info().ID, dev.info.Name)
-								fn.OnConnect(*ctx)
-							}
-						}
-						waitErr := ctx.Wait()
-						s.logf("[%s:%s] disconnect uptime: %s err: %+v", ctx.Info().ID, ctx.Info().Name, time.Since(ctx.ConnectedAt), waitErr)
-						s.fanout(ctx.Device.Info(), KeyEvent, KeyEventDisconnect)
-
-						if s.OnDisconnect != nil {
-							s.OnDisconnect(*ctx, waitErr)
-						}
-						for _, p := range s.Plugins {
-							if fn, ok := p.(ServicePluginOnDisconnect); ok {
-								s.logf("executing %s->OnDisconnect for %s (%s)", p.ServiceName(), dev.Info().ID, dev.info.Name)
-								fn.OnDisconnect(*ctx, waitErr)
-							}
-						}
-					} else {
-						s.logf("[%s:%s] connect err: %+v", ctx.Info().ID, ctx.Info().Name, connectErr)
-						time.Sleep(5 * time.Second)
+				s.applyDeviceConfig(ctx)
+				connected := s.contextCopy(ctx)
+				if s.OnConnect != nil {
+					s.OnConnect(connected)
+				}
+				for _, p := range s.Plugins {
+					if fn, ok := p.(ServicePluginOnConnect); ok {
+						s.deviceLog(ctx).Debug("executing plugin", "plugin", p.ServiceName(), "hook", "OnConnect")
+						fn.OnConnect(connected)
+					}
+				}
+				stopRefresh := s.refreshRegistry(ctx)
+				waitErr := ctx.Wait()
+				stopRefresh()
+				s.deviceLog(ctx).Info("disconnected", "uptime", time.Since(ctx.ConnectedAt), "err", waitErr)
+				s.remember(ctx)
+				s.fanout(ctx.Device.Info(), KeyEvent, KeyEventDisconnect)
+
+				disconnected := s.contextCopy(ctx)
+				if s.OnDisconnect != nil {
+					s.OnDisconnect(disconnected, waitErr)
+				}
+				for _, p := range s.Plugins {
+					if fn, ok := p.(ServicePluginOnDisconnect); ok {
+						s.deviceLog(ctx).Debug("executing plugin", "plugin", p.ServiceName(), "hook", "OnDisconnect")
+						fn.OnDisconnect(disconnected, waitErr)
+					}
+				}
+			} else {
+				var attempts int
+				var delay time.Duration
+				var retry bool
+				s.exec(func() {
+					ctx.ReconnectAttempts++
+					attempts = ctx.ReconnectAttempts
+					delay, retry = s.reconnectPolicyFor(ctx).NextDelay(attempts)
+					if !retry {
+						ctx.reconnect = false
+						return
 					}
+					ctx.NextReconnectAt = time.Now().Add(delay)
+				})
+				if !retry {
+					s.deviceLog(ctx).Warn("giving up reconnecting", "err", connectErr, "attempts", attempts)
+					break
 				}
-				s.logf("[%s:%s] disabling reconnect err:%+v", ctx.Info().ID, ctx.Info().Name, ctx.Wait())
-			}(ctx)
+				s.deviceLog(ctx).Warn("connect failed", "err", connectErr, "attempt", attempts, "retry_in", delay)
+				time.Sleep(delay)
+			}
 		}
+		s.deviceLog(ctx).Info("disabling reconnect", "err", ctx.Wait())
+	}(ctx)
+}
+
+// contextCopy copies ctx for the callbacks without racing exec
+func (s *Service) contextCopy(ctx *DeviceContext) (c DeviceContext) {
+	s.exec(func() {
+		c = *ctx
 	})
+	return
+}
+
+// reconnecting reports whether the connect loop of ctx should keep going
+func (s *Service) reconnecting(ctx *DeviceContext) (ok bool) {
+	s.exec(func() {
+		ok = ctx.reconnect
+	})
+	return
 }
 
 func (s *Service) Subscribe(filter string) *Subscription {
-	sub := &Subscription{
-		filter: filter,
-		ch:     make(chan Message, 10),
-		execCh: s.fnCh,
-	}
+	return s.SubscribeWithOptions(filter, SubscribeOptions{})
+}
+
+// SubscribeWithOptions subscribes to every device, keys are prefixed with the
+// device ID. With Replay the snapshot covers every connected device. Updates
+// reach a Service subscription through the device, so a value changing while
+// the snapshot is taken may be delivered twice but is never lost.
+func (s *Service) SubscribeWithOptions(filter string, opts SubscribeOptions) *Subscription {
+	sub := newSubscription(s, filter, opts)
 	s.exec(func() {
+		var snapshot []Message
+		if opts.Replay {
+			ids := make([]string, 0, len(s.devices))
+			for id := range s.devices {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			// hold every device until the subscription is registered so no
+			// update lands between its snapshot and the first live message
+			for _, id := range ids {
+				ctx := s.devices[id]
+				if !ctx.Connected() {
+					continue
+				}
+				ctx.valuesLock.Lock()
+				defer ctx.valuesLock.Unlock()
+				snapshot = append(snapshot, ctx.snapshot(id+".", sub.match)...)
+			}
+		}
+		sub.open(snapshot, Metadata{})
+
+		s.subscriptionsLock.Lock()
 		s.subscriptions = append(s.subscriptions, sub)
+		s.subscriptionsLock.Unlock()
 	})
 	return sub
 }
 
-func (s Service) RenderDevicesTable(w io.Writer) {
+func (s *Service) RenderDevicesTable(w io.Writer) {
 	table := tablewriter.NewWriter(w)
 	table.SetHeader([]string{"ID", "Name", "Model", "HW VER", "FW VER", "Addr", "Uptime"})
 
@@ -267,23 +523,46 @@ func (s Service) RenderDevicesTable(w io.Writer) {
 	table.Render()
 }
 
-func (s *Service) ScanAndRegister() (err error) {
+func (s *Service) ScanAndRegister() error {
+	return s.ScanAndRegisterContext(context.Background())
+}
+
+// ScanAndRegisterContext scans s.Networks with s.ScanOptions and registers
+// every device as soon as it is found, it returns once they are all
+// registered. See ScanContext for the errors returned.
+func (s *Service) ScanAndRegisterContext(ctx context.Context) (err error) {
 	if s.Networks == nil {
 		s.Networks, err = LocalNetworks()
 		if err != nil {
 			return
 		}
 	}
+	opts := s.ScanOptions
+	opts.Networks = s.Networks
+	// register devices while the scan is still running
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+	opts.OnFound = func(m MetadataAndAddr) {
+		if s.ScanOptions.OnFound != nil {
+			s.ScanOptions.OnFound(m)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Register(m)
+		}()
+	}
 
 	strNet := make([]string, 0, len(s.Networks))
 	for _, n := range s.Networks {
-		strNet = append(strNet, n.To4().String())
+		strNet = append(strNet, n.String())
 	}
-	s.logf("Attempting discovery on %s", strings.Join(strNet, ", "))
+	s.log().Info("attempting discovery", "networks", strings.Join(strNet, ", "))
 	var devs []MetadataAndAddr
-	devs, err = Scan(s.Networks...)
-	for _, m := range devs {
-		s.Register(m)
+	start := time.Now()
+	devs, err = ScanContext(ctx, opts)
+	if s.Observer != nil {
+		s.Observer.ObserveScan(time.Since(start), len(devs), err)
 	}
 	return
 }
@@ -0,0 +1,108 @@
+package iotfwdrv_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pborges/iotfwdrv"
+	"github.com/pborges/iotfwdrv/iotfwtest"
+)
+
+// unreachable returns an address nothing is listening on
+func unreachable(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+	return addr
+}
+
+func TestRestoreUnreachable(t *testing.T) {
+	registry := iotfwdrv.NewFileRegistry(filepath.Join(t.TempDir(), "registry.json"))
+	svc := &iotfwdrv.Service{
+		ReconnectPolicy: iotfwdrv.ConstantBackoff{Delay: 10 * time.Millisecond},
+		Registry:        registry,
+		RegistryMaxAge:  time.Hour,
+	}
+	// start the exec loop before counting
+	svc.Device("dev1")
+	before := runtime.NumGoroutine()
+
+	// the entry ages out after a few dozen failed attempts
+	err := registry.Put(iotfwdrv.RegistryEntry{
+		MetadataAndAddr: iotfwdrv.MetadataAndAddr{
+			Metadata: iotfwdrv.Metadata{ID: "dev1"},
+			Addr:     *unreachable(t),
+		},
+		LastSeen: time.Now().Add(-time.Hour + 300*time.Millisecond),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if entries, err := registry.List(); err == nil && len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("unreachable device never aged out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	settle(t, before)
+}
+
+func TestApplyConfigRemoveClosesDevice(t *testing.T) {
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	addr, err := fake.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		fake.Close()
+	})
+	svc := &iotfwdrv.Service{ReconnectPolicy: iotfwdrv.ConstantBackoff{Delay: time.Hour}}
+	svc.Device("dev1")
+	before := runtime.NumGoroutine()
+
+	svc.ApplyConfig(iotfwdrv.Config{Devices: []iotfwdrv.DeviceConfig{{Addr: addr.String()}}})
+	deadline := time.Now().Add(2 * time.Second)
+	for dev := svc.Device("dev1"); dev == nil || !dev.Connected(); dev = svc.Device("dev1") {
+		if time.Now().After(deadline) {
+			t.Fatal("configured device never connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	svc.ApplyConfig(iotfwdrv.Config{})
+	if svc.Device("dev1") != nil {
+		t.Fatal("removed device still registered")
+	}
+	settle(t, before)
+}
+
+func TestWatchConfigDefaultInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"devices":[]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// a ticker of 0 panics in the watch goroutine
+	svc := &iotfwdrv.Service{}
+	if err := svc.WatchConfig(ctx, path, 0); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+}
@@ -1,41 +1,352 @@
 package iotfwdrv
 
-import "sync"
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrSubscriptionClosed = errors.New("subscription closed")
+var ErrSlowSubscriber = errors.New("slow subscriber")
+var ErrDisconnected = errors.New("disconnected")
+
+const defaultSubscriptionBuffer = 10
+const defaultBlockTimeout = time.Second
+
+// SlowPolicy decides what happens to a message when a subscriber's buffer is full
+type SlowPolicy int
+
+const (
+	// SlowClose closes the subscription, the default
+	SlowClose SlowPolicy = iota
+	// SlowDropNewest discards the message that did not fit
+	SlowDropNewest
+	// SlowDropOldest discards the oldest buffered message to make room, a
+	// replayed snapshot and its marker are kept
+	SlowDropOldest
+	// SlowCoalesce holds back only the latest value of each key once the
+	// buffer is full, older values of the same key are discarded
+	SlowCoalesce
+	// SlowBlock waits up to BlockTimeout for room then discards the message,
+	// this stalls delivery to every other subscriber of the same source. On a
+	// Device subscription it also stalls the connection reader, so command
+	// responses wait too and a BlockTimeout near Device.Timeout gets the
+	// connection closed as unresponsive.
+	SlowBlock
+)
+
+func (p SlowPolicy) String() string {
+	switch p {
+	case SlowClose:
+		return "close"
+	case SlowDropNewest:
+		return "drop-newest"
+	case SlowDropOldest:
+		return "drop-oldest"
+	case SlowCoalesce:
+		return "coalesce"
+	case SlowBlock:
+		return "block"
+	}
+	return "unknown"
+}
+
+// SubscribeOptions configures a Subscription
+type SubscribeOptions struct {
+	// Replay first delivers the current value of every matching attribute
+	// followed by a KeySnapshot message marking the start of live updates
+	Replay       bool
+	BufferSize   int
+	SlowPolicy   SlowPolicy
+	BlockTimeout time.Duration
+}
+
+// subscriptionOwner is the Device or Service a Subscription receives messages from
+type subscriptionOwner interface {
+	unsubscribe(sub *Subscription)
+}
 
 type Subscription struct {
-	ch     chan Message
-	device *Device
-	filter string
-	execCh chan func()
+	dropped      uint64 // accessed atomically, keep 64-bit aligned
+	ch           chan Message
+	opts         SubscribeOptions
+	owner        subscriptionOwner
+	filters      []string
+	filtersLock  sync.Mutex
+	deliverLock  sync.Mutex
+	closed       bool
+	err          error
+	pending      map[string]Message
+	pendingKeys  []string
+	inflight     bool
+	pendingReady chan struct{}
+	done         chan struct{}
+}
+
+func newSubscription(owner subscriptionOwner, filter string, opts SubscribeOptions) *Subscription {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultSubscriptionBuffer
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = defaultBlockTimeout
+	}
+	sub := &Subscription{
+		opts:  opts,
+		owner: owner,
+		done:  make(chan struct{}),
+	}
+	sub.AddFilter(filter)
+	return sub
 }
 
-func (s *Subscription) exec(fn func()) {
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	s.execCh <- func() {
-		fn()
-		wg.Done()
+// open creates the channel and queues the replayed snapshot ahead of any live
+// message, the channel grows to fit the snapshot and its marker
+func (s *Subscription) open(snapshot []Message, info Metadata) {
+	size := s.opts.BufferSize
+	if s.opts.Replay {
+		size += len(snapshot) + 1
+	}
+	s.ch = make(chan Message, size)
+	if s.opts.Replay {
+		for _, m := range snapshot {
+			s.ch <- m
+		}
+		s.ch <- Message{Device: info, Key: KeySnapshot, Value: KeySnapshotEnd}
+	}
+	if s.opts.SlowPolicy == SlowCoalesce {
+		s.pending = make(map[string]Message)
+		s.pendingReady = make(chan struct{}, 1)
+		go s.flushPending()
 	}
-	wg.Wait()
 }
 
 func (s *Subscription) String() string {
-	return "Subscription: " + s.filter
+	return "Subscription: " + s.Filter()
 }
 
 func (s *Subscription) Chan() <-chan Message {
 	return s.ch
 }
 
-func (s *Subscription) Close() {
-	s.exec(func() {
-		for i, sub := range s.device.subscriptions {
-			if s == sub {
-				close(s.ch)
-				s.device.subscriptions[i] = s.device.subscriptions[len(s.device.subscriptions)-1] // Copy last element to index i.
-				s.device.subscriptions[len(s.device.subscriptions)-1] = nil                       // Erase last element (write zero value).
-				s.device.subscriptions = s.device.subscriptions[:len(s.device.subscriptions)-1]   // Truncate slice.
+// Err returns why the subscription was closed or nil while it is open, use
+// errors.Is with ErrSubscriptionClosed, ErrSlowSubscriber or ErrDisconnected
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Dropped returns how many messages were discarded because the subscriber
+// could not keep up
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Filter returns the current filters joined in the form accepted by KeyMatch
+func (s *Subscription) Filter() string {
+	s.filtersLock.Lock()
+	defer s.filtersLock.Unlock()
+	return strings.Join(s.filters, ",")
+}
+
+// AddFilter adds one or more comma separated patterns to the subscription
+func (s *Subscription) AddFilter(filter string) {
+	s.filtersLock.Lock()
+	defer s.filtersLock.Unlock()
+	for _, f := range strings.Split(filter, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			s.filters = append(s.filters, f)
+		}
+	}
+}
+
+// RemoveFilter removes patterns previously added, each comma separated
+// pattern must match exactly what was added
+func (s *Subscription) RemoveFilter(filter string) {
+	s.filtersLock.Lock()
+	defer s.filtersLock.Unlock()
+	for _, f := range strings.Split(filter, ",") {
+		f = strings.TrimSpace(f)
+		for i, existing := range s.filters {
+			if existing == f {
+				s.filters = append(s.filters[:i], s.filters[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func (s *Subscription) match(key string) bool {
+	return KeyMatch(key, s.Filter())
+}
+
+// deliver hands m to the subscriber according to its SlowPolicy, it returns
+// false when the subscriber should be closed for falling behind
+func (s *Subscription) deliver(m Message) bool {
+	s.deliverLock.Lock()
+	defer s.deliverLock.Unlock()
+	if s.closed {
+		return true
+	}
+
+	if s.opts.SlowPolicy == SlowCoalesce {
+		// only go straight to the channel when nothing is queued ahead of m
+		if len(s.pendingKeys) == 0 && !s.inflight {
+			select {
+			case s.ch <- m:
+				return true
+			default:
 			}
 		}
-	})
+		if _, ok := s.pending[m.Key]; ok {
+			atomic.AddUint64(&s.dropped, 1)
+		} else {
+			s.pendingKeys = append(s.pendingKeys, m.Key)
+		}
+		s.pending[m.Key] = m
+		select {
+		case s.pendingReady <- struct{}{}:
+		default:
+		}
+		return true
+	}
+
+	select {
+	case s.ch <- m:
+		return true
+	default:
+	}
+
+	switch s.opts.SlowPolicy {
+	case SlowDropNewest:
+	case SlowDropOldest:
+		s.dropOldest(m)
+		return true
+	case SlowBlock:
+		t := time.NewTimer(s.opts.BlockTimeout)
+		defer t.Stop()
+		select {
+		case s.ch <- m:
+			return true
+		case <-t.C:
+		}
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		return false
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	return true
+}
+
+// dropOldest makes room for m by discarding the oldest live message, the
+// replayed snapshot and its marker are never discarded. The queue is taken
+// out and put back in order, the subscriber may keep reading meanwhile.
+func (s *Subscription) dropOldest(m Message) {
+	queued := make([]Message, 0, cap(s.ch))
+drain:
+	for {
+		select {
+		case q := <-s.ch:
+			queued = append(queued, q)
+		default:
+			break drain
+		}
+	}
+
+	live := 0
+	if s.opts.Replay {
+		for i, q := range queued {
+			if q.Key == KeySnapshot {
+				live = i + 1
+				break
+			}
+		}
+	}
+	// with nothing live queued m itself is the oldest live message
+	if live < len(queued) {
+		queued = append(queued[:live], queued[live+1:]...)
+		queued = append(queued, m)
+	}
+	atomic.AddUint64(&s.dropped, 1)
+	for _, q := range queued {
+		s.ch <- q
+	}
+}
+
+// flushPending feeds coalesced messages to the channel in the order their keys
+// first became pending, it owns closing the channel for SlowCoalesce
+func (s *Subscription) flushPending() {
+	defer close(s.ch)
+	for {
+		select {
+		case <-s.pendingReady:
+		case <-s.done:
+			return
+		}
+		for {
+			s.deliverLock.Lock()
+			if len(s.pendingKeys) == 0 {
+				s.deliverLock.Unlock()
+				break
+			}
+			key := s.pendingKeys[0]
+			s.pendingKeys = s.pendingKeys[1:]
+			m := s.pending[key]
+			delete(s.pending, key)
+			s.inflight = true
+			s.deliverLock.Unlock()
+
+			select {
+			case s.ch <- m:
+			case <-s.done:
+				return
+			}
+			s.deliverLock.Lock()
+			s.inflight = false
+			s.deliverLock.Unlock()
+		}
+	}
+}
+
+// shutdown stops delivery and closes the channel recording err as the reason,
+// callers must have removed the subscription from its owner first
+func (s *Subscription) shutdown(err error) {
+	s.deliverLock.Lock()
+	defer s.deliverLock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.err = err
+	close(s.done)
+	if s.opts.SlowPolicy != SlowCoalesce {
+		close(s.ch)
+	}
+}
+
+func (s *Subscription) closeWithErr(err error) {
+	s.owner.unsubscribe(s)
+	s.shutdown(err)
+}
+
+// Close stops the subscription and closes its channel, it is safe to call
+// more than once and from any goroutine
+func (s *Subscription) Close() {
+	s.closeWithErr(ErrSubscriptionClosed)
+}
+
+func removeSubscription(subs []*Subscription, sub *Subscription) []*Subscription {
+	for i, existing := range subs {
+		if existing == sub {
+			subs[i] = subs[len(subs)-1] // Copy last element to index i.
+			subs[len(subs)-1] = nil     // Erase last element (write zero value).
+			return subs[:len(subs)-1]   // Truncate slice.
+		}
+	}
+	return subs
 }
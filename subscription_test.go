@@ -0,0 +1,221 @@
+package iotfwdrv_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pborges/iotfwdrv"
+	"github.com/pborges/iotfwdrv/iotfwtest"
+)
+
+// flush returns once every push the fake sent before it has been delivered,
+// the device answers in order so a round trip is enough
+func flush(t *testing.T, dev *iotfwdrv.Device) {
+	t.Helper()
+	if _, err := dev.Execute("ping", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// received reads sub until it is closed or stays quiet, formatting each
+// message as key=value
+func received(sub *iotfwdrv.Subscription) []string {
+	var got []string
+	for {
+		select {
+		case m, ok := <-sub.Chan():
+			if !ok {
+				return got
+			}
+			got = append(got, m.Key+"="+m.Value)
+		case <-time.After(100 * time.Millisecond):
+			return got
+		}
+	}
+}
+
+func TestSubscribeReplay(t *testing.T) {
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	fake.SetAttr("relay.1", "false")
+	fake.SetAttr("relay.0", "true")
+	fake.SetAttr("led", "off")
+	dev := connect(t, fake)
+
+	sub := dev.SubscribeWithOptions("relay.*,led", iotfwdrv.SubscribeOptions{Replay: true})
+	defer sub.Close()
+	fake.SetAttr("relay.1", "true")
+	fake.SetAttr("config.name", "ignored")
+	fake.SetAttr("led", "on")
+	flush(t, dev)
+
+	want := []string{
+		// the snapshot sorted by key, then the marker, then live updates
+		"led=off", "relay.0=true", "relay.1=false",
+		iotfwdrv.KeySnapshot + "=" + iotfwdrv.KeySnapshotEnd,
+		"relay.1=true", "led=on",
+	}
+	if got := received(sub); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestSubscribeReplayEmpty(t *testing.T) {
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	dev := connect(t, fake)
+
+	sub := dev.SubscribeWithOptions("relay.*", iotfwdrv.SubscribeOptions{Replay: true})
+	defer sub.Close()
+	want := []string{iotfwdrv.KeySnapshot + "=" + iotfwdrv.KeySnapshotEnd}
+	if got := received(sub); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+// overflow subscribes with a two message buffer and pushes value 1 to 5 of
+// each key before the subscriber reads anything
+func overflow(t *testing.T, opts iotfwdrv.SubscribeOptions, keys ...string) (*iotfwdrv.Subscription, []string) {
+	t.Helper()
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	dev := connect(t, fake)
+
+	opts.BufferSize = 2
+	sub := dev.SubscribeWithOptions(">", opts)
+	t.Cleanup(sub.Close)
+	for i := 1; i <= 5; i++ {
+		for _, key := range keys {
+			fake.SetAttr(key, strconv.Itoa(i))
+		}
+	}
+	flush(t, dev)
+	return sub, received(sub)
+}
+
+func TestSlowDropNewest(t *testing.T) {
+	sub, got := overflow(t, iotfwdrv.SubscribeOptions{SlowPolicy: iotfwdrv.SlowDropNewest}, "a")
+	if want := []string{"a=1", "a=2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if sub.Dropped() != 3 || sub.Err() != nil {
+		t.Fatalf("dropped %d err %v, want 3 and still open", sub.Dropped(), sub.Err())
+	}
+}
+
+func TestSlowDropOldest(t *testing.T) {
+	sub, got := overflow(t, iotfwdrv.SubscribeOptions{SlowPolicy: iotfwdrv.SlowDropOldest}, "a")
+	if want := []string{"a=4", "a=5"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if sub.Dropped() != 3 || sub.Err() != nil {
+		t.Fatalf("dropped %d err %v, want 3 and still open", sub.Dropped(), sub.Err())
+	}
+}
+
+func TestSlowCoalesce(t *testing.T) {
+	sub, got := overflow(t, iotfwdrv.SubscribeOptions{SlowPolicy: iotfwdrv.SlowCoalesce}, "a", "b")
+	if len(got) >= 10 || uint64(len(got))+sub.Dropped() != 10 {
+		t.Fatalf("got %v with %d dropped, want fewer than 10 adding up to 10", got, sub.Dropped())
+	}
+	// every key ends on its latest value and never goes back in time
+	last := map[string]int{}
+	for _, kv := range got {
+		var key string
+		var v int
+		if _, err := fmt.Sscanf(kv, "%1s=%d", &key, &v); err != nil {
+			t.Fatal(err)
+		}
+		if v <= last[key] {
+			t.Fatalf("got %v, %s went back to %d", got, key, v)
+		}
+		last[key] = v
+	}
+	if last["a"] != 5 || last["b"] != 5 {
+		t.Fatalf("got %v, want both keys to end at 5", got)
+	}
+}
+
+func TestSlowClose(t *testing.T) {
+	sub, got := overflow(t, iotfwdrv.SubscribeOptions{}, "a")
+	if want := []string{"a=1", "a=2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if !errors.Is(sub.Err(), iotfwdrv.ErrSlowSubscriber) {
+		t.Fatalf("err %v, want ErrSlowSubscriber", sub.Err())
+	}
+}
+
+func TestSlowBlock(t *testing.T) {
+	sub, got := overflow(t, iotfwdrv.SubscribeOptions{
+		SlowPolicy:   iotfwdrv.SlowBlock,
+		BlockTimeout: 10 * time.Millisecond,
+	}, "a")
+	if want := []string{"a=1", "a=2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if sub.Dropped() != 3 || sub.Err() != nil {
+		t.Fatalf("dropped %d err %v, want 3 and still open", sub.Dropped(), sub.Err())
+	}
+}
+
+func TestSlowBlockWaitsForReader(t *testing.T) {
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	dev := connect(t, fake)
+
+	sub := dev.SubscribeWithOptions("a", iotfwdrv.SubscribeOptions{
+		BufferSize:   1,
+		SlowPolicy:   iotfwdrv.SlowBlock,
+		BlockTimeout: time.Second,
+	})
+	defer sub.Close()
+	done := make(chan []string)
+	go func() {
+		var got []string
+		for m := range sub.Chan() {
+			got = append(got, m.Value)
+			time.Sleep(5 * time.Millisecond)
+			if len(got) == 5 {
+				break
+			}
+		}
+		done <- got
+	}()
+	for i := 1; i <= 5; i++ {
+		fake.SetAttr("a", strconv.Itoa(i))
+	}
+	if got, want := <-done, []string{"1", "2", "3", "4", "5"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if sub.Dropped() != 0 {
+		t.Fatalf("dropped %d, want 0", sub.Dropped())
+	}
+}
+
+func TestSlowDropOldestKeepsReplay(t *testing.T) {
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	fake.SetAttr("a", "0")
+	fake.SetAttr("b", "0")
+	dev := connect(t, fake)
+
+	sub := dev.SubscribeWithOptions("a,b", iotfwdrv.SubscribeOptions{
+		Replay:     true,
+		BufferSize: 2,
+		SlowPolicy: iotfwdrv.SlowDropOldest,
+	})
+	defer sub.Close()
+	for i := 1; i <= 5; i++ {
+		fake.SetAttr("a", strconv.Itoa(i))
+		fake.SetAttr("b", strconv.Itoa(i))
+	}
+	flush(t, dev)
+
+	want := []string{"a=0", "b=0", iotfwdrv.KeySnapshot + "=" + iotfwdrv.KeySnapshotEnd, "a=5", "b=5"}
+	if got := received(sub); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if sub.Dropped() != 8 {
+		t.Fatalf("dropped %d, want 8", sub.Dropped())
+	}
+}
@@ -0,0 +1,119 @@
+package iotfwdrv
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+var ErrAttributeNotFound = errors.New("attribute not found")
+
+// Lookup returns the cached value of attr and whether the device reported it,
+// unlike Get it distinguishes a missing attribute from an empty one
+func (dev *Device) Lookup(attr string) (string, bool) {
+	dev.valuesLock.Lock()
+	defer dev.valuesLock.Unlock()
+	val, ok := dev.values[attr]
+	return val, ok
+}
+
+// Values returns a copy of every cached attribute value
+func (dev *Device) Values() map[string]string {
+	dev.valuesLock.Lock()
+	defer dev.valuesLock.Unlock()
+	values := make(map[string]string, len(dev.values))
+	for attr, val := range dev.values {
+		values[attr] = val
+	}
+	return values
+}
+
+func (dev *Device) lookup(attr string) (string, error) {
+	val, ok := dev.Lookup(attr)
+	if !ok {
+		return "", fmt.Errorf("%s: %w", attr, ErrAttributeNotFound)
+	}
+	return val, nil
+}
+
+func (dev *Device) GetBool(attr string) (bool, error) {
+	val, err := dev.lookup(attr)
+	if err != nil {
+		return false, err
+	}
+	return parseBool(attr, val)
+}
+
+func (dev *Device) GetInt(attr string) (int64, error) {
+	val, err := dev.lookup(attr)
+	if err != nil {
+		return 0, err
+	}
+	return parseInt(attr, val)
+}
+
+func (dev *Device) GetFloat(attr string) (float64, error) {
+	val, err := dev.lookup(attr)
+	if err != nil {
+		return 0, err
+	}
+	return parseFloat(attr, val)
+}
+
+// GetDuration parses values in the form accepted by time.ParseDuration
+func (dev *Device) GetDuration(attr string) (time.Duration, error) {
+	val, err := dev.lookup(attr)
+	if err != nil {
+		return 0, err
+	}
+	return parseDuration(attr, val)
+}
+
+func (m Message) Bool() (bool, error) {
+	return parseBool(m.Key, m.Value)
+}
+
+func (m Message) Int() (int64, error) {
+	return parseInt(m.Key, m.Value)
+}
+
+func (m Message) Float() (float64, error) {
+	return parseFloat(m.Key, m.Value)
+}
+
+func (m Message) Duration() (time.Duration, error) {
+	return parseDuration(m.Key, m.Value)
+}
+
+func parseBool(key string, val string) (bool, error) {
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", key, err)
+	}
+	return b, nil
+}
+
+func parseInt(key string, val string) (int64, error) {
+	i, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return i, nil
+}
+
+func parseFloat(key string, val string) (float64, error) {
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return f, nil
+}
+
+func parseDuration(key string, val string) (time.Duration, error) {
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,173 @@
+// Package wiretap records the lines exchanged with iotfw devices to JSONL and
+// replays recorded sessions back as a fake device, so field problems can be
+// reproduced offline with the same Device and Service code.
+package wiretap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Direction is relative to the driver, a read is a line sent by the device
+type Direction string
+
+const (
+	DirOpen  Direction = "open"
+	DirRead  Direction = "read"
+	DirWrite Direction = "write"
+	DirClose Direction = "close"
+)
+
+// Entry is one line of a recording, Conn numbers the connections made
+// through a Recorder starting at 1
+type Entry struct {
+	Time time.Time `json:"time"`
+	Conn int       `json:"conn"`
+	Dir  Direction `json:"dir"`
+	Line string    `json:"line,omitempty"`
+	Err  string    `json:"err,omitempty"`
+}
+
+// Recorder writes an Entry for every line read or written on the connections
+// it wraps, it is safe to share between devices
+type Recorder struct {
+	lock  sync.Mutex
+	enc   *json.Encoder
+	conns int
+	err   error
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Err returns the first error writing the recording, recording stops after it
+func (r *Recorder) Err() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(e Entry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.err != nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	r.err = r.enc.Encode(e)
+}
+
+func (r *Recorder) nextConn() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.conns++
+	return r.conns
+}
+
+// Dialer wraps dial for use with iotfwdrv.New, failed dials are recorded too
+func (r *Recorder) Dialer(dial func() (io.ReadWriteCloser, error)) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		conn := r.nextConn()
+		rwc, err := dial()
+		if err != nil {
+			r.record(Entry{Conn: conn, Dir: DirOpen, Err: err.Error()})
+			return nil, err
+		}
+		r.record(Entry{Conn: conn, Dir: DirOpen})
+		return &recordedConn{rwc: rwc, recorder: r, conn: conn}, nil
+	}
+}
+
+// Wrap records an already established connection
+func (r *Recorder) Wrap(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	conn := r.nextConn()
+	r.record(Entry{Conn: conn, Dir: DirOpen})
+	return &recordedConn{rwc: rwc, recorder: r, conn: conn}
+}
+
+type recordedConn struct {
+	rwc       io.ReadWriteCloser
+	recorder  *Recorder
+	conn      int
+	readBuf   bytes.Buffer
+	writeBuf  bytes.Buffer
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+	closeOnce sync.Once
+}
+
+func (c *recordedConn) Read(p []byte) (int, error) {
+	n, err := c.rwc.Read(p)
+	c.readLock.Lock()
+	c.readBuf.Write(p[:n])
+	c.flush(&c.readBuf, DirRead)
+	c.readLock.Unlock()
+	if err != nil {
+		c.closed(err)
+	}
+	return n, err
+}
+
+// Write records before writing so the entry lands ahead of any response,
+// synchronous transports such as net.Pipe would otherwise reorder them
+func (c *recordedConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	c.writeBuf.Write(p)
+	c.flush(&c.writeBuf, DirWrite)
+	c.writeLock.Unlock()
+	return c.rwc.Write(p)
+}
+
+func (c *recordedConn) Close() error {
+	err := c.rwc.Close()
+	c.closed(nil)
+	return err
+}
+
+// flush records every complete line in buf
+func (c *recordedConn) flush(buf *bytes.Buffer, dir Direction) {
+	for {
+		idx := bytes.IndexByte(buf.Bytes(), '\n')
+		if idx < 0 {
+			return
+		}
+		line := buf.Next(idx + 1)
+		c.recorder.record(Entry{Conn: c.conn, Dir: dir, Line: string(bytes.TrimRight(line, "\r\n"))})
+	}
+}
+
+func (c *recordedConn) closed(err error) {
+	c.closeOnce.Do(func() {
+		e := Entry{Conn: c.conn, Dir: DirClose}
+		if err != nil && !errors.Is(err, io.EOF) {
+			e.Err = err.Error()
+		}
+		c.recorder.record(e)
+	})
+}
+
+// ReadEntries parses a recording written by a Recorder
+func ReadEntries(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
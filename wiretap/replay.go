@@ -0,0 +1,167 @@
+package wiretap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pborges/iotfwdrv/proto"
+)
+
+var ErrNoMoreSessions = errors.New("no more recorded connections")
+
+// Replayer plays recorded connections back in order, the n-th dial gets the
+// n-th recorded connection. Lines the device sent are written as recorded,
+// lines the driver sent are awaited by command name and anything the driver
+// sends that is not in the recording, such as a keepalive ping, is answered
+// with ok. Request ids are rewritten to match the live driver.
+type Replayer struct {
+	// Realtime reproduces the recorded delays before each device line
+	Realtime bool
+	lock     sync.Mutex
+	sessions [][]Entry
+	next     int
+}
+
+func NewReplayer(entries []Entry) *Replayer {
+	byConn := make(map[int][]Entry)
+	for _, e := range entries {
+		byConn[e.Conn] = append(byConn[e.Conn], e)
+	}
+	conns := make([]int, 0, len(byConn))
+	for conn := range byConn {
+		conns = append(conns, conn)
+	}
+	sort.Ints(conns)
+
+	r := &Replayer{}
+	for _, conn := range conns {
+		r.sessions = append(r.sessions, byConn[conn])
+	}
+	return r
+}
+
+// Dialer returns a dialer for iotfwdrv.New that serves each dial over net.Pipe,
+// recorded dial failures are returned as errors
+func (r *Replayer) Dialer() func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		session, err := r.nextSession()
+		if err != nil {
+			return nil, err
+		}
+		if len(session) > 0 && session[0].Dir == DirOpen && session[0].Err != "" {
+			return nil, errors.New(session[0].Err)
+		}
+		client, server := net.Pipe()
+		go func() {
+			_ = r.serve(server, session)
+		}()
+		return client, nil
+	}
+}
+
+// Serve replays the next recorded connection on rwc
+func (r *Replayer) Serve(rwc io.ReadWriteCloser) error {
+	session, err := r.nextSession()
+	if err != nil {
+		rwc.Close()
+		return err
+	}
+	return r.serve(rwc, session)
+}
+
+func (r *Replayer) nextSession() ([]Entry, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.next >= len(r.sessions) {
+		return nil, ErrNoMoreSessions
+	}
+	session := r.sessions[r.next]
+	r.next++
+	return session, nil
+}
+
+func (r *Replayer) serve(rwc io.ReadWriteCloser, session []Entry) error {
+	defer rwc.Close()
+	decoder := proto.NewDecoder(rwc)
+	encoder := proto.NewEncoder(rwc)
+
+	// recorded request id -> live request id
+	ids := make(map[uint64]uint64)
+	var last time.Time
+
+	for _, e := range session {
+		switch e.Dir {
+		case DirRead:
+			if r.Realtime && !last.IsZero() {
+				time.Sleep(e.Time.Sub(last))
+			}
+			last = e.Time
+			p, err := proto.Parse(e.Line)
+			if err != nil {
+				// replay it byte for byte, the driver saw it that way too
+				if _, err := io.WriteString(rwc, e.Line+"\n"); err != nil {
+					return err
+				}
+				continue
+			}
+			if id, ok := ids[p.ID]; ok {
+				p.ID = id
+			}
+			if err := encoder.Encode(p); err != nil {
+				return err
+			}
+		case DirWrite:
+			last = e.Time
+			want, err := proto.Parse(e.Line)
+			if err != nil {
+				return fmt.Errorf("recorded line %q: %w", e.Line, err)
+			}
+			got, err := r.await(decoder, encoder, want.Cmd)
+			if err != nil {
+				return err
+			}
+			if want.ID != 0 {
+				ids[want.ID] = got.ID
+			}
+		case DirClose:
+			return nil
+		}
+	}
+
+	// the recording ended with the connection still open, keep it alive
+	for {
+		p, err := decoder.Decode()
+		if err != nil {
+			return nil
+		}
+		if err := encoder.Encode(proto.Packet{ID: p.ID, Cmd: "ok"}); err != nil {
+			return err
+		}
+	}
+}
+
+// await reads from the driver until it sends cmd, answering anything else
+// with ok so keepalives do not stall the replay
+func (r *Replayer) await(decoder *proto.Decoder, encoder *proto.Encoder, cmd string) (proto.Packet, error) {
+	for {
+		p, err := decoder.Decode()
+		if err != nil {
+			var syntaxErr *proto.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				continue
+			}
+			return p, err
+		}
+		if p.Cmd == cmd {
+			return p, nil
+		}
+		if err := encoder.Encode(proto.Packet{ID: p.ID, Cmd: "ok"}); err != nil {
+			return p, err
+		}
+	}
+}
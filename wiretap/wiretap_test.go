@@ -0,0 +1,120 @@
+package wiretap_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pborges/iotfwdrv"
+	"github.com/pborges/iotfwdrv/iotfwtest"
+	"github.com/pborges/iotfwdrv/wiretap"
+)
+
+// lockedBuffer lets the test read what the device goroutines are writing
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// record runs a session against fake and returns what was recorded
+func record(t *testing.T, fake *iotfwtest.Device) []wiretap.Entry {
+	t.Helper()
+	out := new(lockedBuffer)
+	rec := wiretap.NewRecorder(out)
+	dev := iotfwdrv.New(rec.Dialer(fake.Dialer()))
+	if err := dev.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Set("relay.0", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := wiretap.ReadEntries(strings.NewReader(out.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || entries[0].Dir != wiretap.DirOpen || entries[len(entries)-1].Dir != wiretap.DirClose {
+		t.Fatalf("recording does not go from open to close: %+v", entries)
+	}
+	return entries
+}
+
+func replay(t *testing.T, fake *iotfwtest.Device, entries []wiretap.Entry) {
+	t.Helper()
+	r := wiretap.NewReplayer(entries)
+	dev := iotfwdrv.New(r.Dialer())
+	defer dev.Close()
+	if err := dev.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if info := dev.Info(); info != fake.Metadata() {
+		t.Fatalf("replayed info %+v, want %+v", info, fake.Metadata())
+	}
+	if v := dev.Get("relay.0"); v != "false" {
+		t.Fatalf("replayed relay.0 = %q before set, want false", v)
+	}
+	if err := dev.Set("relay.0", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if v := dev.Get("relay.0"); v != "true" {
+		t.Fatalf("replayed relay.0 = %q after set, want true", v)
+	}
+
+	again := iotfwdrv.New(r.Dialer())
+	defer again.Close()
+	if err := again.Connect(); !errors.Is(err, wiretap.ErrNoMoreSessions) {
+		t.Fatalf("second dial = %v, want ErrNoMoreSessions", err)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	fake.SetAttr("relay.0", "false")
+	entries := record(t, fake)
+
+	var wrote []string
+	for _, e := range entries {
+		if e.Dir == wiretap.DirWrite {
+			wrote = append(wrote, strings.Fields(e.Line)[0])
+		}
+	}
+	if got := strings.Join(wrote, ","); got != "info,list,sub,set" {
+		t.Fatalf("recorded writes %s, want info,list,sub,set", got)
+	}
+	replay(t, fake, entries)
+}
+
+func TestRecordReplayPipelined(t *testing.T) {
+	fake := iotfwtest.NewDevice("dev1", "Device One")
+	fake.Pipelining = true
+	fake.SetAttr("relay.0", "false")
+	entries := record(t, fake)
+
+	var tagged bool
+	for _, e := range entries {
+		tagged = tagged || (e.Dir == wiretap.DirWrite && strings.Contains(e.Line, "rid:"))
+	}
+	if !tagged {
+		t.Fatalf("no request ids recorded: %+v", entries)
+	}
+	replay(t, fake, entries)
+}